@@ -0,0 +1,206 @@
+package lambdafs
+
+import (
+	"strconv"
+	"sync"
+	"syscall"
+
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/hanwen/go-fuse/fuse/nodefs"
+)
+
+// ContextKeyer is implemented by transformers whose output depends on the calling process,
+// callers given the same key share the same output.
+// Outputs of such transformers are kept in memory like virtual files, one per key, and never written to the rw dir.
+// filePath is the source file, as given to Transformer.Transform.
+type ContextKeyer interface {
+	CacheKey(filePath string, caller *fuse.Context) string
+}
+
+type callerKeyedTransformer struct {
+	Transformer
+	key func(filePath string, caller *fuse.Context) string
+}
+
+// KeyedByCaller declares the output of transformer depends on the part of the caller returned by key,
+// the caller is then given as TransformContext.Caller
+func KeyedByCaller(key func(filePath string, caller *fuse.Context) string, transformer Transformer) Transformer {
+	return &callerKeyedTransformer{Transformer: transformer, key: key}
+}
+
+func (transformer *callerKeyedTransformer) CacheKey(filePath string, caller *fuse.Context) string {
+	return transformer.key(filePath, caller)
+}
+
+func (transformer *callerKeyedTransformer) Unwrap() Transformer {
+	return transformer.Transformer
+}
+
+// ByUid keys the output by the uid of the caller
+func ByUid(filePath string, caller *fuse.Context) string {
+	return strconv.FormatUint(uint64(caller.Uid), 10)
+}
+
+func keyerOf(transformer Transformer) ContextKeyer {
+	keyer, _ := lookupCapability(transformer, func(transformer Transformer) bool {
+		if pipeline, ok := transformer.(*Pipeline); ok {
+			// a pipeline is keyed when any of its stages is
+			return pipeline.keyed()
+		}
+		_, ok := transformer.(ContextKeyer)
+		return ok
+	}).(ContextKeyer)
+	return keyer
+}
+
+// callerEntries remembers what each caller output was generated from, they are not persisted
+type callerEntries struct {
+	lock    sync.Mutex
+	entries map[string]*ManifestEntry
+}
+
+func (entries *callerEntries) Get(key string) *ManifestEntry {
+	entries.lock.Lock()
+	defer entries.lock.Unlock()
+	entry := entries.entries[key]
+	if entry == nil {
+		return nil
+	}
+	copied := *entry
+	return &copied
+}
+
+func (entries *callerEntries) Put(key string, entry *ManifestEntry) {
+	entries.lock.Lock()
+	defer entries.lock.Unlock()
+	if entries.entries == nil {
+		entries.entries = map[string]*ManifestEntry{}
+	}
+	entries.entries[key] = entry
+}
+
+func (entries *callerEntries) Remove(key string) {
+	entries.lock.Lock()
+	defer entries.lock.Unlock()
+	delete(entries.entries, key)
+}
+
+// callerContent returns the output of path for caller when its transformer is keyed by caller,
+// false means path is served the usual way
+func (fs *LambdaFileSystem) callerContent(path string, caller *fuse.Context) ([]byte, bool, fuse.Status) {
+	if !fs.hasTransformers() || fs.isMetaPath(path) {
+		return nil, false, fuse.OK
+	}
+	transformerId, transformer := fs.transformerFor(path)
+	keyer := keyerOf(transformer)
+	if keyer == nil {
+		return nil, false, fuse.OK
+	}
+	if _, err := getAttr(fs.cache, path); err == nil {
+		// written through the mount, shared by every caller
+		return nil, false, fuse.OK
+	}
+	if fs.isWhitedOut(path) {
+		return nil, false, fuse.OK
+	}
+	if caller == nil {
+		caller = &fuse.Context{}
+	}
+	cacheKey := path + "\x00" + keyer.CacheKey(fs.sourceFilePathOf(path), caller)
+	fs.foreground.Enter()
+	defer fs.foreground.Leave()
+	// the output may be evicted before it is read, it is then transformed again
+	for attempt := 0; attempt < 3; attempt++ {
+		code := fs.flights.Do(cacheKey, func() fuse.Status {
+			return fs.syncCallerOutput(path, cacheKey, caller, transformerId, transformer)
+		})
+		if !code.Ok() {
+			return nil, true, code
+		}
+		entry := fs.callerEntries.Get(cacheKey)
+		if entry == nil || entry.Origin == OriginDeclined {
+			return nil, false, fuse.OK
+		}
+		content, found := fs.virtualFiles.Get(cacheKey)
+		if found {
+			return content, true, fuse.OK
+		}
+	}
+	LogWarning("caller output evicted before read", "path", path)
+	return nil, true, fuse.Status(syscall.EAGAIN)
+}
+
+func (fs *LambdaFileSystem) syncCallerOutput(path string, cacheKey string, caller *fuse.Context, transformerId string, transformer Transformer) fuse.Status {
+	attr, layer, err := statSource(fs.origin, path)
+	if err != nil || !attr.IsRegular() {
+		fs.callerEntries.Remove(cacheKey)
+		fs.virtualFiles.Remove(cacheKey)
+		return fuse.OK
+	}
+	fingerprint := fingerprintOf(transformer)
+	entry := fs.callerEntries.Get(cacheKey)
+	if entry != nil && (entry.Origin == OriginDeclined || fs.virtualFiles.Has(cacheKey)) &&
+		fs.isFresh(path, newSourceStamp(attr, layer), nil, entry, fingerprint) {
+		return fuse.OK
+	}
+	if ShouldLogDebug() {
+		LogDebug("about to update caller output", "path", path, "uid", caller.Uid, "pid", caller.Pid)
+	}
+	ctx := fs.newTransformContext(path, layer)
+	ctx.Caller = caller
+	dst := &memoryWriter{}
+	updated, err := fs.executeTransform(ctx, transformer, dst, nil)
+	if err == ErrTransformQueueFull {
+		LogWarning("transform queue is full", "reason", "Caller", "path", path)
+		return fuse.Status(syscall.EAGAIN)
+	}
+	if err == ErrTransformTimeout {
+		LogError("transform timed out", "reason", "Caller", "path", path)
+		return fuse.EIO
+	}
+	entry = &ManifestEntry{
+		Path:         path,
+		Source:       newSourceStamp(attr, layer),
+		Transformer:  transformerId,
+		Fingerprint:  fingerprint,
+		Dependencies: ctx.dependencies(),
+	}
+	if err != nil {
+		LogError("failed to update caller output", "path", path, "err", err)
+		fs.transformErrors.Set(path, err.Error())
+		switch fs.OnError {
+		case FailOnError:
+			fs.callerEntries.Remove(cacheKey)
+			fs.virtualFiles.Remove(cacheKey)
+			return fuse.EIO
+		case ServeErrorFileOnError:
+			entry.Origin = OriginError
+			entry.Error = err.Error()
+			fs.virtualFiles.Put(cacheKey, []byte(errorFileContent(path, entry.Error)), fs.VirtualCacheBytes)
+			fs.callerEntries.Put(cacheKey, entry)
+		default:
+			fs.callerEntries.Remove(cacheKey)
+			fs.virtualFiles.Remove(cacheKey)
+		}
+		return fuse.OK
+	}
+	fs.transformErrors.Clear(path)
+	if !updated {
+		entry.Origin = OriginDeclined
+		fs.virtualFiles.Remove(cacheKey)
+	} else {
+		entry.Origin = OriginVirtual
+		fs.virtualFiles.Put(cacheKey, dst.content, fs.VirtualCacheBytes)
+	}
+	fs.callerEntries.Put(cacheKey, entry)
+	return fuse.OK
+}
+
+// openCallerOutput bypasses the kernel page cache, shared by every caller of the same file
+func (fs *LambdaFileSystem) openCallerOutput(path string, content []byte, context *fuse.Context) (nodefs.File, fuse.Status) {
+	file, code := fs.openVirtualFile(path, content, context)
+	if !code.Ok() {
+		return nil, code
+	}
+	return &nodefs.WithFlags{File: file, Description: "caller output", FuseFlags: fuse.FOPEN_DIRECT_IO}, fuse.OK
+}
@@ -0,0 +1,62 @@
+package lambdafs
+
+import (
+	"os"
+)
+
+// ConflictPolicy decides what happens to a file written through the mount when its source changes
+type ConflictPolicy int
+
+const (
+	// keep the user edit, the source change is not transformed
+	ConflictKeepUser ConflictPolicy = iota
+	// replace the user edit with the transformed source
+	ConflictRegenerate
+	// move the user edit aside as <file>.lambdafs-conflict, then transform the source
+	ConflictSaveBoth
+)
+
+const conflictSuffix = ".lambdafs-conflict"
+
+func (policy ConflictPolicy) String() string {
+	switch policy {
+	case ConflictKeepUser:
+		return "keep-user"
+	case ConflictRegenerate:
+		return "regenerate"
+	case ConflictSaveBoth:
+		return "save-both"
+	}
+	return "unknown"
+}
+
+// resolveConflict clears the way for regenerating a rw copy written through the mount,
+// it returns false if the user edit must be kept as is
+func (fs *LambdaFileSystem) resolveConflict(path string) bool {
+	LogWarning("user edit conflicts with source change", "path", path, "policy", fs.OnConflict)
+	switch fs.OnConflict {
+	case ConflictRegenerate:
+		err := statusError(fs.cache.Unlink(path, nil))
+		if err != nil && !os.IsNotExist(err) {
+			LogError("failed to remove user edit", "path", path, "err", err)
+			return false
+		}
+		fs.dropBranchCache(path)
+		fs.manifest.Remove(path)
+		return true
+	case ConflictSaveBoth:
+		conflictPath := path + conflictSuffix
+		err := statusError(fs.cache.Rename(path, conflictPath, nil))
+		if err != nil {
+			LogError("failed to save user edit", "path", path, "err", err)
+			return false
+		}
+		fs.dropBranchCache(path)
+		fs.dropBranchCache(conflictPath)
+		fs.manifest.Remove(path)
+		fs.manifest.Put(&ManifestEntry{Path: conflictPath, Origin: OriginUser})
+		LogInfo("saved user edit", "path", conflictPath)
+		return true
+	}
+	return false
+}
@@ -0,0 +1,25 @@
+package lambdafs
+
+// declineFile remembers the transformer declined the source of path,
+// so it is not asked again until the source or the transformer changes.
+// A rw copy or virtual file generated before is removed for the source to show through.
+func (fs *LambdaFileSystem) declineFile(path string, stamp *SourceStamp, transformerId string, fingerprint string) {
+	entry := fs.manifest.Get(path)
+	if entry != nil && (entry.Origin == OriginGenerated || entry.Origin == OriginError || entry.Origin == OriginVirtual) {
+		fs.cache.Unlink(path, nil)
+		fs.dropBranchCache(path)
+		fs.virtualFiles.Remove(path)
+	} else if entry != nil && entry.Origin != OriginDeclined {
+		return
+	}
+	if ShouldLogTrace() {
+		LogTrace("file is declined", "path", path)
+	}
+	fs.manifest.Put(&ManifestEntry{
+		Path:        path,
+		Origin:      OriginDeclined,
+		Source:      stamp,
+		Transformer: transformerId,
+		Fingerprint: fingerprint,
+	})
+}
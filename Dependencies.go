@@ -0,0 +1,162 @@
+package lambdafs
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/hanwen/go-fuse/fuse/pathfs"
+)
+
+// TransformContext describes the file being transformed and records the other files the transform reads,
+// the output is generated again once any of them changes
+type TransformContext struct {
+	// Path of the file relative to the mount root
+	Path string
+	// FilePath is the source file, as given to Transformer.Transform
+	FilePath string
+	// Caller is the process accessing the file, only given to transformers keyed by caller
+	Caller   *fuse.Context
+	origin   pathfs.FileSystem
+	origDirs []string
+	lock     sync.Mutex
+	deps     map[string]*SourceStamp
+}
+
+// ContextTransformer is implemented by transformers taking a TransformContext,
+// it is used in place of Transform whenever lambdafs has a context to give
+type ContextTransformer interface {
+	TransformWithContext(ctx *TransformContext, src io.Reader, dst io.Writer) error
+}
+
+// ContextTransformFunc is a transformer taking a TransformContext,
+// called without one, dependencies are opened but not recorded
+type ContextTransformFunc func(ctx *TransformContext, src io.Reader, dst io.Writer) error
+
+func (transform ContextTransformFunc) Transform(filePath string, src io.Reader, dst io.Writer) error {
+	return transform(&TransformContext{FilePath: filePath}, src, dst)
+}
+
+func (transform ContextTransformFunc) TransformWithContext(ctx *TransformContext, src io.Reader, dst io.Writer) error {
+	return transform(ctx, src, dst)
+}
+
+// newTransformContext describes path, its source coming from the given origin layer
+func (fs *LambdaFileSystem) newTransformContext(path string, layer int) *TransformContext {
+	return &TransformContext{Path: path, FilePath: fs.sourceFilePath(path, layer), origin: fs.origin, origDirs: fs.origDirs}
+}
+
+// originPath turns a local path inside one of origDirs into the path relative to the origin,
+// the one changes are reported with. Other paths are returned as is.
+func originPath(origDirs []string, path string) string {
+	if !filepath.IsAbs(path) {
+		return path
+	}
+	for _, origDir := range origDirs {
+		origDir, err := filepath.Abs(origDir)
+		if err != nil {
+			continue
+		}
+		relative, err := filepath.Rel(origDir, path)
+		if err != nil || relative == "." || relative == ".." || strings.HasPrefix(relative, ".."+string(filepath.Separator)) {
+			continue
+		}
+		return relative
+	}
+	return path
+}
+
+// dependencyStamp stats a dependency recorded as path, relative paths are in origin, absolute ones are local files
+func dependencyStamp(origin pathfs.FileSystem, path string) (*SourceStamp, error) {
+	if filepath.IsAbs(path) || origin == nil {
+		fileInfo, err := os.Stat(path)
+		if err != nil {
+			return nil, err
+		}
+		return newSourceStamp(fuse.ToAttr(fileInfo), 0), nil
+	}
+	attr, layer, err := statSource(origin, path)
+	if err != nil {
+		return nil, err
+	}
+	return newSourceStamp(attr, layer), nil
+}
+
+// Open opens path, relative to the origin unless absolute, and records it as a dependency.
+// A missing file is recorded too, so creating it regenerates the output.
+func (ctx *TransformContext) Open(path string) (io.ReadCloser, error) {
+	ctx.Depend(path)
+	if filepath.IsAbs(path) || ctx.origin == nil {
+		return os.Open(path)
+	}
+	return openFile(ctx.origin, filepath.Clean(path))
+}
+
+// Depend records path, relative to the origin unless absolute, as a dependency read by other means than Open
+func (ctx *TransformContext) Depend(path string) {
+	if ctx.origin == nil {
+		return
+	}
+	path = originPath(ctx.origDirs, filepath.Clean(path))
+	stamp, _ := dependencyStamp(ctx.origin, path)
+	ctx.lock.Lock()
+	defer ctx.lock.Unlock()
+	if ctx.deps == nil {
+		ctx.deps = map[string]*SourceStamp{}
+	}
+	if _, found := ctx.deps[path]; !found {
+		ctx.deps[path] = stamp
+	}
+}
+
+func (ctx *TransformContext) dependencies() map[string]*SourceStamp {
+	ctx.lock.Lock()
+	defer ctx.lock.Unlock()
+	return ctx.deps
+}
+
+func contextTransformerOf(transformer Transformer) ContextTransformer {
+	contextTransformer, _ := lookupCapability(transformer, func(transformer Transformer) bool {
+		_, ok := transformer.(ContextTransformer)
+		return ok
+	}).(ContextTransformer)
+	return contextTransformer
+}
+
+// transformWith gives ctx to transformer if it takes one
+func transformWith(ctx *TransformContext, transformer Transformer, filePath string, src io.Reader, dst io.Writer) error {
+	if ctx != nil {
+		if contextTransformer := contextTransformerOf(transformer); contextTransformer != nil {
+			return contextTransformer.TransformWithContext(ctx, src, dst)
+		}
+	}
+	return transformer.Transform(filePath, src, dst)
+}
+
+// dependenciesFresh tells if none of the dependencies recorded with entry changed since
+func (fs *LambdaFileSystem) dependenciesFresh(entry *ManifestEntry) bool {
+	for path, stamp := range entry.Dependencies {
+		current, err := dependencyStamp(fs.origin, path)
+		if err != nil {
+			if stamp != nil {
+				return false
+			}
+			continue
+		}
+		if stamp == nil || !current.sameFileInfo(stamp) {
+			if ShouldLogTrace() {
+				LogTrace("dependency changed", "path", entry.Path, "dependency", path)
+			}
+			return false
+		}
+	}
+	return true
+}
+
+// dependents lists the paths whose output depends on path
+func (fs *LambdaFileSystem) dependents(path string) []string {
+	return fs.manifest.Dependents(path)
+}
@@ -0,0 +1,247 @@
+package lambdafs
+
+import (
+	"path/filepath"
+	"sync"
+
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/hanwen/go-fuse/fuse/nodefs"
+)
+
+// DirEntry is an entry of a directory listing as shown through the mount
+type DirEntry struct {
+	Name string
+	// Source is the path of the file shown under Name, relative to the mount root before directory transforms.
+	// Empty for a virtual entry.
+	Source string
+	// Mode only tells the file type, S_IFREG is assumed for a virtual entry
+	Mode uint32
+	// Content generates a virtual entry, it is read-only and called again once the listing is refreshed
+	Content func() ([]byte, error)
+}
+
+// DirTransformFunc reshapes the listing of dirPath: leave out entries to hide them,
+// add entries with Content to synthesize files, or change Name to show Source under another name.
+// A source left out of the result is not reachable through the mount, even by name.
+type DirTransformFunc func(dirPath string, entries []DirEntry) ([]DirEntry, error)
+
+// dirView is the transformed listing of a directory
+type dirView struct {
+	code    fuse.Status
+	listing []fuse.DirEntry
+	entries map[string]*viewEntry
+}
+
+type viewEntry struct {
+	DirEntry
+	once    sync.Once
+	content []byte
+	err     error
+}
+
+func (entry *viewEntry) getContent() ([]byte, error) {
+	entry.once.Do(func() {
+		entry.content, entry.err = entry.Content()
+	})
+	return entry.content, entry.err
+}
+
+// resolvedPath is what a path under the mount stands for
+type resolvedPath struct {
+	// path before directory transforms
+	path string
+	// set when path is a virtual entry of its dir
+	virtual *viewEntry
+}
+
+func (fs *LambdaFileSystem) fetchDirView(dirPath string) (interface{}, bool) {
+	stream, code := fs.delegate.OpenDir(dirPath, nil)
+	if !code.Ok() {
+		return &dirView{code: code}, false
+	}
+	entries := make([]DirEntry, 0, len(stream))
+	for _, entry := range stream {
+		entries = append(entries, DirEntry{
+			Name:   entry.Name,
+			Source: filepath.Join(dirPath, entry.Name),
+			Mode:   entry.Mode,
+		})
+	}
+	if fs.PathMapper != nil {
+		entries = fs.mapDirEntries(entries)
+	}
+	if fs.TransformDir != nil {
+		var err error
+		entries, err = fs.TransformDir(dirPath, entries)
+		if err != nil {
+			LogError("failed to transform dir", "path", dirPath, "err", err)
+			return &dirView{code: fuse.EIO}, false
+		}
+	}
+	view := &dirView{code: fuse.OK, entries: map[string]*viewEntry{}}
+	for _, entry := range entries {
+		if entry.Content != nil {
+			entry.Source = ""
+			if entry.Mode == 0 {
+				entry.Mode = fuse.S_IFREG
+			}
+		}
+		if _, duplicated := view.entries[entry.Name]; duplicated {
+			continue
+		}
+		view.listing = append(view.listing, fuse.DirEntry{Name: entry.Name, Mode: entry.Mode})
+		view.entries[entry.Name] = &viewEntry{DirEntry: entry}
+	}
+	return view, true
+}
+
+// reshapesTree tells if paths under the mount are resolved through transformed listings
+func (fs *LambdaFileSystem) reshapesTree() bool {
+	return fs.TransformDir != nil || fs.PathMapper != nil
+}
+
+func (fs *LambdaFileSystem) dirView(dirPath string) *dirView {
+	return fs.dirViews.Get(dirPath).(*dirView)
+}
+
+// dropDirView makes the listing of the dir holding path built again on next access
+func (fs *LambdaFileSystem) dropDirView(path string) {
+	if !fs.reshapesTree() {
+		return
+	}
+	dir := filepath.Dir(path)
+	if dir == "." {
+		dir = ""
+	}
+	fs.dirViews.DropEntry(dir)
+}
+
+// mountPaths are the paths the source path is shown as under the mount, found in the listing of every parent dir.
+// The mapped name is included as well, the kernel may hold it as missing when path was just created.
+func (fs *LambdaFileSystem) mountPaths(path string) []string {
+	if !fs.reshapesTree() || path == "" {
+		return []string{path}
+	}
+	dir := parentDir(path)
+	names := map[string]bool{}
+	if fs.PathMapper != nil {
+		names[filepath.Base(fs.PathMapper.MountPath(path))] = true
+	} else {
+		names[filepath.Base(path)] = true
+	}
+	for _, entry := range fs.dirView(dir).entries {
+		if entry.Source == path {
+			names[entry.Name] = true
+		}
+	}
+	var paths []string
+	for _, mountDir := range fs.mountPaths(dir) {
+		for name := range names {
+			paths = append(paths, filepath.Join(mountDir, name))
+		}
+	}
+	return paths
+}
+
+// resolve finds what path under the mount stands for, walking the mapped and transformed listing of every parent dir.
+// Names missing from the listing of their dir are not found.
+func (fs *LambdaFileSystem) resolve(path string) (resolvedPath, fuse.Status) {
+	if !fs.reshapesTree() || path == "" || fs.isMetaPath(path) {
+		return resolvedPath{path: path}, fuse.OK
+	}
+	parent, code := fs.resolveDir(filepath.Dir(path))
+	if !code.Ok() {
+		return resolvedPath{}, code
+	}
+	view := fs.dirView(parent)
+	if !view.code.Ok() {
+		return resolvedPath{}, view.code
+	}
+	entry, found := view.entries[filepath.Base(path)]
+	if !found {
+		return resolvedPath{}, fuse.ENOENT
+	}
+	if entry.Content != nil {
+		return resolvedPath{path: filepath.Join(parent, entry.Name), virtual: entry}, fuse.OK
+	}
+	return resolvedPath{path: entry.Source}, fuse.OK
+}
+
+func (fs *LambdaFileSystem) resolveDir(dir string) (string, fuse.Status) {
+	if dir == "." {
+		return "", fuse.OK
+	}
+	resolved, code := fs.resolve(dir)
+	if !code.Ok() {
+		return "", code
+	}
+	if resolved.virtual != nil {
+		return "", fuse.ENOTDIR
+	}
+	return resolved.path, fuse.OK
+}
+
+// resolveFile resolves a path about to be modified, virtual entries are read-only
+func (fs *LambdaFileSystem) resolveFile(path string) (string, fuse.Status) {
+	resolved, code := fs.resolve(path)
+	if !code.Ok() {
+		return "", code
+	}
+	if resolved.virtual != nil {
+		return "", fuse.EPERM
+	}
+	return resolved.path, fuse.OK
+}
+
+// resolveNew resolves a path about to be created, the name is kept as is under the resolved parent
+func (fs *LambdaFileSystem) resolveNew(path string) (string, fuse.Status) {
+	if !fs.reshapesTree() {
+		return path, fuse.OK
+	}
+	if resolved, code := fs.resolve(path); code.Ok() {
+		if resolved.virtual != nil {
+			return "", fuse.EPERM
+		}
+		return resolved.path, fuse.OK
+	}
+	parent, code := fs.resolveDir(filepath.Dir(path))
+	if !code.Ok() {
+		return "", code
+	}
+	return filepath.Join(parent, filepath.Base(path)), fuse.OK
+}
+
+func (fs *LambdaFileSystem) virtualEntryAttr(resolved resolvedPath, context *fuse.Context) (*fuse.Attr, fuse.Status) {
+	content, err := resolved.virtual.getContent()
+	if err != nil {
+		LogError("failed to generate virtual entry", "path", resolved.path, "err", err)
+		return nil, fuse.EIO
+	}
+	dir := filepath.Dir(resolved.path)
+	if dir == "." {
+		dir = ""
+	}
+	dirAttr, code := fs.delegate.GetAttr(dir, context)
+	if !code.Ok() {
+		return nil, code
+	}
+	attr := *dirAttr
+	attr.Ino = 0
+	attr.Nlink = 1
+	attr.Mode = fuse.S_IFREG | 0444
+	attr.Size = uint64(len(content))
+	attr.Blocks = (attr.Size + 511) / 512
+	return &attr, fuse.OK
+}
+
+func (fs *LambdaFileSystem) openVirtualEntry(resolved resolvedPath, flags uint32, context *fuse.Context) (nodefs.File, fuse.Status) {
+	if flags&fuse.O_ANYWRITE != 0 {
+		return nil, fuse.EPERM
+	}
+	attr, code := fs.virtualEntryAttr(resolved, context)
+	if !code.Ok() {
+		return nil, code
+	}
+	content, _ := resolved.virtual.getContent()
+	return &virtualFile{File: nodefs.NewDataFile(content), attr: attr}, fuse.OK
+}
@@ -0,0 +1,128 @@
+package lambdafs
+
+import (
+	"fmt"
+	"io/ioutil"
+	"sync"
+
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+// ErrorPolicy decides what a reader gets when the transformer of a file fails
+type ErrorPolicy int
+
+const (
+	// serve the untransformed source, a stale rw copy generated before is removed
+	ServeOriginalOnError ErrorPolicy = iota
+	// fail opening the file with EIO
+	FailOnError
+	// serve a generated file describing the error in place of the output,
+	// it is kept until the source or the transformer changes
+	ServeErrorFileOnError
+)
+
+// ErrorXAttr exposes the last transform error of a file
+const ErrorXAttr = "user.lambdafs.error"
+
+// transformErrors remembers the last transform error per path
+type transformErrors struct {
+	lock   sync.Mutex
+	errors map[string]string
+}
+
+func (errors *transformErrors) Set(path string, message string) {
+	errors.lock.Lock()
+	defer errors.lock.Unlock()
+	if errors.errors == nil {
+		errors.errors = map[string]string{}
+	}
+	errors.errors[path] = message
+}
+
+func (errors *transformErrors) Clear(path string) {
+	errors.lock.Lock()
+	defer errors.lock.Unlock()
+	delete(errors.errors, path)
+}
+
+func (errors *transformErrors) Get(path string) (string, bool) {
+	errors.lock.Lock()
+	defer errors.lock.Unlock()
+	message, found := errors.errors[path]
+	return message, found
+}
+
+// LastError returns the message of the last failed transform of path, the error file kept in rw included
+func (fs *LambdaFileSystem) LastError(path string) (string, bool) {
+	message, found := fs.transformErrors.Get(path)
+	if found {
+		return message, true
+	}
+	entry := fs.manifest.Get(path)
+	if entry != nil && entry.Origin == OriginError {
+		return entry.Error, true
+	}
+	return "", false
+}
+
+// errorFileContent describes the failed transform of path in place of its output
+func errorFileContent(path string, message string) string {
+	return fmt.Sprintf("lambdafs: failed to transform %s: %s\n", path, message)
+}
+
+// servesContent reads path back through unionfs, telling if content is what readers get
+func (fs *LambdaFileSystem) servesContent(path string, content string) bool {
+	file, err := openFile(fs.delegate, path)
+	if err != nil {
+		return false
+	}
+	defer file.Close()
+	served, err := ioutil.ReadAll(file)
+	return err == nil && string(served) == content
+}
+
+// handleTransformError applies the error policy to a failed transform of path, attr is the one of its source
+func (fs *LambdaFileSystem) handleTransformError(path string, attr *fuse.Attr, stamp *SourceStamp, transformerId string, fingerprint string, err error) {
+	message := err.Error()
+	fs.transformErrors.Set(path, message)
+	switch fs.OnError {
+	case ServeOriginalOnError:
+		entry := fs.manifest.Get(path)
+		if entry != nil && (entry.Origin == OriginGenerated || entry.Origin == OriginError || entry.Origin == OriginVirtual) {
+			fs.cache.Unlink(path, nil)
+			fs.dropBranchCache(path)
+			fs.virtualFiles.Remove(path)
+			fs.manifest.Remove(path)
+		}
+	case ServeErrorFileOnError:
+		content := errorFileContent(path, message)
+		if fs.VirtualFiles {
+			fs.virtualFiles.Put(path, []byte(content), fs.VirtualCacheBytes)
+		} else {
+			// the error file is not meant to be run, the mode of the source is taken as is
+			dst := fs.newAtomicFileWriter(path, fs.sourceMetadata(path, attr, attr.Mode&07777))
+			_, writeErr := dst.Write([]byte(content))
+			if writeErr == nil {
+				writeErr = dst.Close()
+			}
+			if writeErr != nil {
+				dst.Discard()
+				LogError("failed to write error file", "path", path, "err", writeErr)
+				return
+			}
+			// unionfs may have found path in origin while the transformer declined it
+			fs.dropBranchCache(path)
+			if !fs.servesContent(path, content) {
+				LogError("error file is not served in place of the source", "path", path)
+			}
+		}
+		fs.manifest.Put(&ManifestEntry{
+			Path:        path,
+			Origin:      OriginError,
+			Source:      stamp,
+			Transformer: transformerId,
+			Fingerprint: fingerprint,
+			Error:       message,
+		})
+	}
+}
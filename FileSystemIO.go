@@ -0,0 +1,160 @@
+package lambdafs
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/hanwen/go-fuse/fuse/nodefs"
+	"github.com/hanwen/go-fuse/fuse/pathfs"
+)
+
+// statusError turns a failed fuse status into an error, os.IsNotExist and the like work on it
+func statusError(code fuse.Status) error {
+	if code.Ok() {
+		return nil
+	}
+	return syscall.Errno(code)
+}
+
+// fileReader reads a nodefs.File sequentially
+type fileReader struct {
+	file   nodefs.File
+	offset int64
+}
+
+func (r *fileReader) Read(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	result, code := r.file.Read(p, r.offset)
+	if !code.Ok() {
+		return 0, statusError(code)
+	}
+	data, code := result.Bytes(p)
+	n := copy(p, data)
+	result.Done()
+	if !code.Ok() {
+		return 0, statusError(code)
+	}
+	if n == 0 {
+		return 0, io.EOF
+	}
+	r.offset += int64(n)
+	return n, nil
+}
+
+func (r *fileReader) Close() error {
+	r.file.Release()
+	return nil
+}
+
+// fileWriter writes a nodefs.File sequentially
+type fileWriter struct {
+	file   nodefs.File
+	offset int64
+}
+
+func (w *fileWriter) Write(p []byte) (int, error) {
+	written, code := w.file.Write(p, w.offset)
+	w.offset += int64(written)
+	if !code.Ok() {
+		return int(written), statusError(code)
+	}
+	if int(written) < len(p) {
+		return int(written), io.ErrShortWrite
+	}
+	return int(written), nil
+}
+
+func (w *fileWriter) Close() error {
+	code := w.file.Flush()
+	w.file.Release()
+	return statusError(code)
+}
+
+func openFile(fs pathfs.FileSystem, path string) (io.ReadCloser, error) {
+	file, code := fs.Open(path, uint32(os.O_RDONLY), nil)
+	if !code.Ok() {
+		return nil, statusError(code)
+	}
+	return &fileReader{file: file}, nil
+}
+
+func createFile(fs pathfs.FileSystem, path string, mode uint32) (*fileWriter, error) {
+	file, code := fs.Create(path, uint32(os.O_WRONLY|os.O_CREATE|os.O_TRUNC), mode, nil)
+	if !code.Ok() {
+		return nil, statusError(code)
+	}
+	return &fileWriter{file: file}, nil
+}
+
+// getAttr fails like os.Stat when path does not exist
+func getAttr(fs pathfs.FileSystem, path string) (*fuse.Attr, error) {
+	attr, code := fs.GetAttr(path, nil)
+	if !code.Ok() {
+		return nil, statusError(code)
+	}
+	return attr, nil
+}
+
+// mkdirAll creates dir and its missing parents, an existing dir is not an error
+func mkdirAll(fs pathfs.FileSystem, dir string, mode uint32) error {
+	if dir == "" || dir == "." {
+		return nil
+	}
+	attr, code := fs.GetAttr(dir, nil)
+	if code.Ok() {
+		if !attr.IsDir() {
+			return syscall.ENOTDIR
+		}
+		return nil
+	}
+	err := mkdirAll(fs, parentDir(dir), mode)
+	if err != nil {
+		return err
+	}
+	code = fs.Mkdir(dir, mode, nil)
+	if code == fuse.Status(syscall.EEXIST) {
+		return nil
+	}
+	return statusError(code)
+}
+
+// removeAll removes path and everything under it
+func removeAll(fs pathfs.FileSystem, path string) {
+	attr, code := fs.GetAttr(path, nil)
+	if !code.Ok() {
+		return
+	}
+	if !attr.IsDir() {
+		fs.Unlink(path, nil)
+		return
+	}
+	entries, _ := fs.OpenDir(path, nil)
+	for _, entry := range entries {
+		removeAll(fs, filepath.Join(path, entry.Name))
+	}
+	fs.Rmdir(path, nil)
+}
+
+func parentDir(path string) string {
+	dir := filepath.Dir(path)
+	if dir == "." {
+		return ""
+	}
+	return dir
+}
+
+var tempFileCounter uint64
+
+// tempFileName is a name unlikely to be taken in dir
+func tempFileName(dir string, prefix string) string {
+	suffix := atomic.AddUint64(&tempFileCounter, 1)
+	return filepath.Join(dir, fmt.Sprintf("%s%d-%d-%d", prefix, os.Getpid(), time.Now().UnixNano(), suffix))
+}
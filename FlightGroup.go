@@ -0,0 +1,64 @@
+package lambdafs
+
+import (
+	"sync"
+
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+// flightGroup runs at most one function per key at a time
+type flightGroup struct {
+	lock    sync.Mutex
+	flights map[string]*flight
+}
+
+type flight struct {
+	done   chan struct{}
+	status fuse.Status
+}
+
+// Do runs fn unless another function is in flight for key,
+// in which case it waits for that one to finish and shares its status
+func (group *flightGroup) Do(key string, fn func() fuse.Status) fuse.Status {
+	newFlight, inFlight := group.start(key)
+	if inFlight != nil {
+		<-inFlight.done
+		return inFlight.status
+	}
+	defer group.finish(key, newFlight)
+	newFlight.status = fn()
+	return newFlight.status
+}
+
+// Run always runs fn, after the function in flight for key has finished
+func (group *flightGroup) Run(key string, fn func() fuse.Status) fuse.Status {
+	newFlight, inFlight := group.start(key)
+	for inFlight != nil {
+		<-inFlight.done
+		newFlight, inFlight = group.start(key)
+	}
+	defer group.finish(key, newFlight)
+	newFlight.status = fn()
+	return newFlight.status
+}
+
+func (group *flightGroup) start(key string) (*flight, *flight) {
+	group.lock.Lock()
+	defer group.lock.Unlock()
+	if group.flights == nil {
+		group.flights = map[string]*flight{}
+	}
+	if inFlight, found := group.flights[key]; found {
+		return nil, inFlight
+	}
+	newFlight := &flight{done: make(chan struct{})}
+	group.flights[key] = newFlight
+	return newFlight, nil
+}
+
+func (group *flightGroup) finish(key string, finished *flight) {
+	group.lock.Lock()
+	delete(group.flights, key)
+	group.lock.Unlock()
+	close(finished.done)
+}
@@ -1,6 +1,7 @@
 package lambdafs
 
 import (
+	"errors"
 	"github.com/hanwen/go-fuse/fuse/pathfs"
 	"path/filepath"
 	"github.com/hanwen/go-fuse/fuse"
@@ -8,99 +9,493 @@ import (
 	"time"
 	"os"
 	"github.com/hanwen/go-fuse/unionfs"
+	"bufio"
+	"hash"
+	"io"
 	"io/ioutil"
+	"syscall"
+	"sync"
+	"strings"
 )
 
 type LambdaFileSystem struct {
-	UpdateFile        func(filePath string) ([]byte, error)
-	tempDir           string
-	origDir           string
-	delegate          pathfs.FileSystem
+	UpdateFile         func(filePath string) ([]byte, error)
+	TransformFile      TransformFunc
+	Transformers       TransformerRegistry
+	Invalidation       InvalidationMode
+	// fingerprint of TransformFile and UpdateFile
+	TransformVersion   string
+	PurgeOnMount       bool
+	OnConflict         ConflictPolicy
+	// turn files edited through the mount back into the origin with the inverse of their transformer
+	WriteBack          bool
+	// bounds the transforms running at once, nil runs every transform inline
+	Executor           *TransformExecutor
+	OnError            ErrorPolicy
+	// transform the whole origin in the background once mounted
+	PrewarmOnMount     bool
+	PrewarmParallelism int
+	// watch a local origin with inotify, regenerate changed files and invalidate the kernel cache right away
+	WatchOrigin        bool
+	// keep transform outputs in memory instead of the rw dir, which then only holds what is written through the mount
+	VirtualFiles       bool
+	// bounds the memory held by virtual files, evicted ones are transformed again on next access
+	VirtualCacheBytes  int64
+	// report the source size from GetAttr until a file is opened, instead of transforming it to know its size
+	LazyGetAttr        bool
+	// reshapes directory listings, names are then resolved through the listing of their dir
+	TransformDir       DirTransformFunc
+	// shows files under another name than their source, like ".ts" files as ".js"
+	PathMapper         PathMapper
+	cache              pathfs.FileSystem
+	origin             pathfs.FileSystem
+	// empty unless the origin is made of local dirs
+	origDirs           []string
+	deletionDirName    string
+	delegate           pathfs.FileSystem
+	manifest           *manifest
+	flights            flightGroup
+	transformErrors    transformErrors
+	virtualFiles       virtualFiles
+	callerEntries      callerEntries
+	dirViews           *unionfs.TimedCache
+	foreground         foregroundGate
+	unmounted          chan struct{}
+	nodeFs             *pathfs.PathNodeFs
+	watcher            *originWatcher
 }
 
 func NewLambdaFileSystem(tempDir string, origDir string, opts *unionfs.UnionFsOptions) (*LambdaFileSystem, error) {
-	ufs, err := unionfs.NewUnionFsFromRoots([]string{
-		tempDir/*rw*/,
-		origDir/*ro*/,
-	}, opts, false)
+	return NewLayeredLambdaFileSystem(tempDir, []string{origDir}, opts)
+}
+
+// NewLayeredLambdaFileSystem transforms several origDirs stacked like unionfs branches,
+// the first dir holding a path wins
+func NewLayeredLambdaFileSystem(tempDir string, origDirs []string, opts *unionfs.UnionFsOptions) (*LambdaFileSystem, error) {
+	origins := make([]pathfs.FileSystem, 0, len(origDirs))
+	for _, dir := range append([]string{tempDir}, origDirs...) {
+		if _, err := os.Stat(dir); err != nil {
+			LogError("failed to create unionfs", "err", err)
+			return nil, err
+		}
+	}
+	for _, origDir := range origDirs {
+		origins = append(origins, pathfs.NewLoopbackFileSystem(origDir))
+	}
+	lambdafs_, err := NewLambdaFileSystemFromFileSystems(pathfs.NewLoopbackFileSystem(tempDir), origins, opts)
+	if err != nil {
+		return nil, err
+	}
+	lambdafs_.origDirs = origDirs
+	return lambdafs_, nil
+}
+
+// NewLambdaFileSystemFromFileSystems transforms the files of origins into cache, which must be writable.
+// Origins are stacked like unionfs branches, the first one holding a path wins.
+// Transformers are then given paths relative to the origin, and WatchOrigin has no effect.
+func NewLambdaFileSystemFromFileSystems(cache pathfs.FileSystem, origins []pathfs.FileSystem, opts *unionfs.UnionFsOptions) (*LambdaFileSystem, error) {
+	if len(origins) == 0 {
+		return nil, errors.New("lambdafs: no origin given")
+	}
+	ufsOpts := *opts
+	ufsOpts.HiddenFiles = append([]string{metaDirName}, opts.HiddenFiles...)
+	// the rw branch goes first, then the ro ones
+	ufs, err := unionfs.NewUnionFs(append([]pathfs.FileSystem{cache}, origins...), ufsOpts)
 	if err != nil {
 		LogError("failed to create unionfs", "err", err)
 		return nil, err
 	}
+	// temp files left by a crash
+	removeAll(cache, filepath.Join(metaDirName, "tmp"))
+	manifest, err := openManifest(cache, metaDirName)
+	if err != nil {
+		LogError("failed to open manifest", "err", err)
+		return nil, err
+	}
 	lambdafs_ := &LambdaFileSystem{
-		tempDir: tempDir,
-		origDir: origDir,
+		cache: cache,
+		origin: newOriginLayers(origins),
 		delegate: ufs,
+		manifest: manifest,
+		unmounted: make(chan struct{}),
+		deletionDirName: opts.DeletionDirName,
 	}
+	lambdafs_.foreground.init()
+	lambdafs_.dirViews = unionfs.NewTimedCache(lambdafs_.fetchDirView, opts.BranchCacheTTL)
 	return lambdafs_, nil
 }
 
-func (fs *LambdaFileSystem) beforeFileAccess(action string, path string) {
-	if fs.UpdateFile == nil {
+func (fs *LambdaFileSystem) hasTransformers() bool {
+	return fs.TransformFile != nil || fs.UpdateFile != nil || !fs.Transformers.isEmpty()
+}
+
+// transformerFor looks up the registry first, then falls back to TransformFile and UpdateFile.
+// The returned id is the registry pattern or the name of the fallback field.
+func (fs *LambdaFileSystem) transformerFor(path string) (string, Transformer) {
+	id, transformer := fs.Transformers.Lookup(path)
+	if transformer != nil {
+		return id, transformer
+	}
+	if fs.TransformFile != nil {
+		return "TransformFile", Versioned(fs.TransformVersion, fs.TransformFile)
+	}
+	if fs.UpdateFile != nil {
+		return "UpdateFile", Versioned(fs.TransformVersion, AdaptUpdateFile(fs.UpdateFile))
+	}
+	return "", nil
+}
+
+// LookupManifest tells what lambdafs recorded about path in the rw dir
+func (fs *LambdaFileSystem) LookupManifest(path string) (ManifestEntry, bool) {
+	entry := fs.manifest.Get(path)
+	if entry == nil {
+		return ManifestEntry{}, false
+	}
+	return *entry, true
+}
+
+// ManifestEntries lists every path recorded in the manifest
+func (fs *LambdaFileSystem) ManifestEntries() []ManifestEntry {
+	return fs.manifest.Entries()
+}
+
+// markUserWritten records path as written through the mount,
+// the source stamp of a generated file is kept to compare against later source changes
+func (fs *LambdaFileSystem) markUserWritten(path string) {
+	entry := fs.manifest.Get(path)
+	if entry == nil {
+		entry = &ManifestEntry{Path: path}
+	}
+	if entry.Origin == OriginUser {
 		return
 	}
-	rwPath := filepath.Join(fs.tempDir, path)
-	roPath := filepath.Join(fs.origDir, path)
-	rwFileInfo, err := os.Stat(rwPath)
+	entry.Origin = OriginUser
+	fs.manifest.Put(entry)
+}
+
+// beforeFileAccess brings the rw copy of path up to date,
+// concurrent calls on the same path wait for the one in flight instead of transforming again
+func (fs *LambdaFileSystem) beforeFileAccess(action string, path string) fuse.Status {
+	if !fs.hasTransformers() || fs.isMetaPath(path) {
+		return fuse.OK
+	}
+	fs.foreground.Enter()
+	defer fs.foreground.Leave()
+	return fs.flights.Do(path, func() fuse.Status {
+		return fs.syncRwPath(action, path)
+	})
+}
+
+func (fs *LambdaFileSystem) syncRwPath(action string, path string) fuse.Status {
+	rwAttr, err := getAttr(fs.cache, path)
 	rwPathExists := true
 	if err != nil {
 		rwPathExists = false
 	}
-	fileInfo, err := os.Stat(roPath)
+	attr, layer, err := statSource(fs.origin, path)
 	if err != nil {
-		if rwPathExists {
-			// if file deleted from ro, it should not present in rw
-			os.Remove(rwPath)
-			LogInfo("deleted file", "path", path)
+		fs.collectOrphan(path, rwPathExists)
+		return fuse.OK
+	}
+	if !rwPathExists && fs.isWhitedOut(path) {
+		if ShouldLogTrace() {
+			LogTrace("file is deleted through the mount, skip", "reason", action, "path", path)
 		}
-		return
+		fs.virtualFiles.Remove(path)
+		fs.manifest.Remove(path)
+		return fuse.OK
 	}
-	if fileInfo.IsDir() {
+	if attr.IsDir() {
 		if !rwPathExists {
 			if ShouldLogDebug() {
-				LogDebug("create dir in rw", "reason", action, "rw_path", rwPath)
+				LogDebug("create dir in rw", "reason", action, "path", path)
 			}
-			os.MkdirAll(rwPath, 0755) // ensure directory is created
+			mkdirAll(fs.cache, path, 0755) // ensure directory is created
+			fs.manifest.Put(&ManifestEntry{Path: path, Origin: OriginDir})
 			//os.OpenFile(filepath.Join(rwPath, ".lambdafs-placeholder"), os.O_CREATE | os.O_RDWR, 0644)
 		}
 		if ShouldLogDebug() {
 			LogDebug("skip dir", "path", path)
 		}
-		return
+		return fuse.OK
+	}
+	if !attr.IsRegular() {
+		return fuse.OK
+	}
+	transformerId, transformer := fs.transformerFor(path)
+	if transformer == nil || keyerOf(transformer) != nil {
+		// outputs keyed by caller are generated on access
+		return fuse.OK
+	}
+	entry := fs.manifest.Get(path)
+	if fs.VirtualFiles && rwPathExists && entry != nil && (entry.Origin == OriginGenerated || entry.Origin == OriginError) {
+		// generated before virtual files were turned on
+		fs.cache.Unlink(path, nil)
+		fs.dropBranchCache(path)
+		fs.manifest.Remove(path)
+		rwPathExists = false
+		entry = nil
 	}
-	if rwPathExists && !fileInfo.ModTime().After(rwFileInfo.ModTime()) {
+	userWritten := rwPathExists && entry != nil && entry.Origin == OriginUser
+	declined := !rwPathExists && entry != nil && entry.Origin == OriginDeclined
+	virtual := !rwPathExists && fs.virtualFiles.Has(path)
+	if userWritten && fs.OnConflict == ConflictKeepUser {
+		if ShouldLogTrace() {
+			LogTrace("file is written by user, skip", "reason", action, "path", path)
+		}
+		return fuse.OK
+	}
+	fingerprint := fingerprintOf(transformer)
+	if !rwPathExists {
+		rwAttr = nil
+	}
+	stamp := newSourceStamp(attr, layer)
+	if (rwPathExists || declined || virtual) && fs.isFresh(path, stamp, rwAttr, entry, fingerprint) {
 		if ShouldLogTrace() {
 			LogTrace("file is not modified, skip", "reason", action, "path", path)
 		}
-		return
+		return fuse.OK
+	}
+	if userWritten && !fs.resolveConflict(path) {
+		return fuse.OK
 	}
 	if ShouldLogDebug() {
 		LogDebug("about to update file", "reason", action, "path", path)
 	}
-	content, err := fs.UpdateFile(roPath)
+	var hasher hash.Hash
+	if fs.Invalidation == InvalidateByContentHash {
+		hasher = newContentHash()
+	}
+	var dst transformOutput
+	if fs.VirtualFiles {
+		dst = &memoryWriter{}
+	} else {
+		dst = fs.newAtomicFileWriter(path, fs.sourceMetadata(path, attr, outputMode(fs.sourceFilePath(path, layer), transformer, attr.Mode)))
+	}
+	ctx := fs.newTransformContext(path, layer)
+	updated, err := fs.executeTransform(ctx, transformer, dst, hasher)
+	if err == ErrTransformQueueFull {
+		LogWarning("transform queue is full", "reason", action, "path", path)
+		return fuse.Status(syscall.EAGAIN)
+	}
+	if err == ErrTransformTimeout {
+		LogError("transform timed out", "reason", action, "path", path)
+		return fuse.EIO
+	}
 	if err != nil {
 		LogError("failed to update file", "path", path, "err", err)
-		return
+		fs.handleTransformError(path, attr, stamp, transformerId, fingerprint, err)
+		return fuse.OK
 	}
-	if content == nil {
-		return
+	fs.transformErrors.Clear(path)
+	if hasher != nil {
+		stamp.Hash = formatContentHash(hasher)
 	}
-	rwPathDir := filepath.Dir(rwPath)
-	err = os.MkdirAll(rwPathDir, 0755) // if dir exists, the error is ignored
-	_, err2 := os.Stat(rwPathDir)
-	if err2 != nil {
-		LogError("failed to create rw path dir", "rw_path", rwPath, "err", err)
-		return
+	if !updated {
+		fs.declineFile(path, stamp, transformerId, fingerprint)
+		return fuse.OK
 	}
-	err = ioutil.WriteFile(rwPath, content, 06444)
-	if err != nil {
-		LogError("failed to write rw file", "rw_path", rwPath, "err", err)
-		return
+	origin := OriginGenerated
+	if output, ok := dst.(*memoryWriter); ok {
+		fs.virtualFiles.Put(path, output.content, fs.VirtualCacheBytes)
+		origin = OriginVirtual
+	} else {
+		// unionfs may have looked the path up in origin while it had no rw copy
+		fs.dropBranchCache(path)
 	}
+	fs.manifest.Put(&ManifestEntry{
+		Path:         path,
+		Origin:       origin,
+		Source:       stamp,
+		Transformer:  transformerId,
+		Fingerprint:  fingerprint,
+		Dependencies: ctx.dependencies(),
+	})
 	if ShouldLogDebug() {
-		os.Chtimes(rwPath, time.Now(), fileInfo.ModTime())
-		LogDebug("updated file", "rw_path", rwPath)
+		LogDebug("updated file", "path", path, "origin", origin)
+	}
+	return fuse.OK
+}
+
+// executeTransform transforms ctx into dst and commits the output once the transform is known not to be timed out,
+// so a timed out transform never leaves an output the caller does not record
+func (fs *LambdaFileSystem) executeTransform(ctx *TransformContext, transformer Transformer, dst transformOutput, hasher hash.Hash) (bool, error) {
+	if fs.Executor == nil {
+		updated, err := fs.transformFile(ctx, transformer, dst, hasher, nil)
+		if err != nil {
+			return false, err
+		}
+		return commitOutput(updated, dst)
+	}
+	var lock sync.Mutex
+	var updated, finished, timedOut bool
+	err := fs.Executor.Execute(func(abort <-chan struct{}) error {
+		transformed, err := fs.transformFile(ctx, transformer, dst, hasher, abort)
+		lock.Lock()
+		defer lock.Unlock()
+		updated, finished = transformed, true
+		if timedOut && updated {
+			dst.Discard()
+		}
+		return err
+	})
+	if err == ErrTransformQueueFull || err == ErrTransformTimeout {
+		// the timed out transform may still be running, whichever of it and the caller ends last discards the output
+		lock.Lock()
+		defer lock.Unlock()
+		timedOut = true
+		if finished && updated {
+			dst.Discard()
+		}
+		return false, err
+	}
+	if err != nil {
+		return false, err
+	}
+	return commitOutput(updated, dst)
+}
+
+// commitOutput makes the output of a transform visible
+func commitOutput(updated bool, dst transformOutput) (bool, error) {
+	if !updated {
+		return false, nil
+	}
+	err := dst.Close()
+	if err != nil {
+		dst.Discard()
+		return false, err
+	}
+	return true, nil
+}
+
+// transformOutput receives the output of a transform, none of it is visible before Close
+type transformOutput interface {
+	io.Writer
+	Close() error
+	// Discard drops whatever was written, the previous output is left untouched
+	Discard()
+}
+
+// transformFile streams the source of ctx through transformer into dst, so readers never see a half written output.
+// If hasher is given, the whole source content is fed into it.
+// Once abort is closed, reading the source or writing the output fails.
+// The output is left for the caller to commit when true is returned, and discarded otherwise.
+func (fs *LambdaFileSystem) transformFile(ctx *TransformContext, transformer Transformer, dst transformOutput, hasher hash.Hash, abort <-chan struct{}) (bool, error) {
+	file, err := openFile(fs.origin, ctx.Path)
+	if err != nil {
+		return false, err
+	}
+	defer file.Close()
+	var src io.Reader = &abortableReader{reader: bufio.NewReader(file), abort: abort}
+	if hasher != nil {
+		src = io.TeeReader(src, hasher)
+	}
+	err = transformWith(ctx, transformer, ctx.FilePath, src, &abortableWriter{writer: dst, abort: abort})
+	if err != nil && err != ErrSkipFile {
+		dst.Discard()
+		return false, err
+	}
+	if hasher != nil {
+		// the transformer may not read the source till the end
+		_, drainErr := io.Copy(ioutil.Discard, src)
+		if drainErr != nil {
+			dst.Discard()
+			return false, drainErr
+		}
+	}
+	if err == ErrSkipFile {
+		dst.Discard()
+		return false, nil
+	}
+	if isAborted(abort) {
+		dst.Discard()
+		return false, errTransformAborted
+	}
+	return true, nil
+}
+
+// atomicFileWriter writes to a temp file of the cache then renames it over path with the metadata of the source,
+// the temp file is only created once something is written
+type atomicFileWriter struct {
+	cache   pathfs.FileSystem
+	path    string
+	meta    *outputMetadata
+	tmpPath string
+	file    *fileWriter
+	buffer  *bufio.Writer
+}
+
+func (fs *LambdaFileSystem) newAtomicFileWriter(path string, meta *outputMetadata) *atomicFileWriter {
+	return &atomicFileWriter{cache: fs.cache, path: path, meta: meta}
+}
+
+func (w *atomicFileWriter) open() error {
+	tmpDir := filepath.Join(metaDirName, "tmp")
+	mkdirAll(w.cache, tmpDir, 0755)
+	tmpPath := tempFileName(tmpDir, filepath.Base(w.path)+".")
+	file, err := createFile(w.cache, tmpPath, 0644)
+	if err != nil {
+		LogError("failed to create temp file", "path", w.path, "err", err)
+		return err
+	}
+	w.tmpPath = tmpPath
+	w.file = file
+	w.buffer = bufio.NewWriter(file)
+	return nil
+}
+
+func (w *atomicFileWriter) Write(p []byte) (int, error) {
+	if w.file == nil {
+		if err := w.open(); err != nil {
+			return 0, err
+		}
+	}
+	return w.buffer.Write(p)
+}
+
+// Close moves the written content to path, an empty output still creates the rw file
+func (w *atomicFileWriter) Close() error {
+	if w.file == nil {
+		if err := w.open(); err != nil {
+			return err
+		}
+	}
+	err := w.buffer.Flush()
+	err2 := w.file.Close()
+	w.file = nil
+	if err == nil {
+		err = err2
+	}
+	if err == nil {
+		err = w.meta.apply(w.cache, w.tmpPath)
+	}
+	if err != nil {
+		w.cache.Unlink(w.tmpPath, nil)
+		return err
+	}
+	err = mkdirAll(w.cache, parentDir(w.path), 0755)
+	if err != nil {
+		LogError("failed to create rw path dir", "path", w.path, "err", err)
+		w.cache.Unlink(w.tmpPath, nil)
+		return err
+	}
+	err = statusError(w.cache.Rename(w.tmpPath, w.path, nil))
+	if err != nil {
+		LogError("failed to write rw file", "path", w.path, "err", err)
+		w.cache.Unlink(w.tmpPath, nil)
+		return err
 	}
+	return nil
+}
+
+// Discard removes the temp file, the existing rw file is left untouched
+func (w *atomicFileWriter) Discard() {
+	if w.file == nil {
+		return
+	}
+	w.file.Close()
+	w.cache.Unlink(w.tmpPath, nil)
+	w.file = nil
 }
 
 func (fs *LambdaFileSystem) StatFs(name string) *fuse.StatfsOut {
@@ -109,108 +504,460 @@ func (fs *LambdaFileSystem) StatFs(name string) *fuse.StatfsOut {
 }
 
 func (fs *LambdaFileSystem) OnMount(nodeFs *pathfs.PathNodeFs) {
+	fs.nodeFs = nodeFs
+	if fs.PurgeOnMount {
+		fs.PurgeStaleOutputs()
+	}
+	if fs.PrewarmOnMount && fs.hasTransformers() {
+		go fs.Prewarm(fs.PrewarmParallelism)
+	}
+	if fs.WatchOrigin && len(fs.origDirs) > 0 {
+		watcher, err := startOriginWatcher(fs)
+		if err != nil {
+			LogError("failed to watch origin", "orig_dirs", fs.origDirs, "err", err)
+		}
+		fs.watcher = watcher
+	}
 	fs.delegate.OnMount(nodeFs)
 }
 
 func (fs *LambdaFileSystem) OnUnmount() {
+	close(fs.unmounted)
+	if fs.watcher != nil {
+		fs.watcher.stop()
+	}
 	fs.delegate.OnUnmount()
+	fs.manifest.Close()
 }
 
 func (fs *LambdaFileSystem) GetAttr(name string, context *fuse.Context) (a *fuse.Attr, code fuse.Status) {
-	fs.beforeFileAccess("GetAttr", name)
-	return fs.delegate.GetAttr(name, context)
+	resolved, code := fs.resolve(name)
+	if !code.Ok() {
+		return nil, code
+	}
+	if resolved.virtual != nil {
+		return fs.virtualEntryAttr(resolved, context)
+	}
+	name = resolved.path
+	if content, keyed, code := fs.callerContent(name, context); keyed {
+		if !code.Ok() {
+			return nil, code
+		}
+		a, code = fs.delegate.GetAttr(name, context)
+		if code.Ok() {
+			a = fs.virtualAttr(name, a, content)
+		}
+		return a, code
+	}
+	if a, provisional := fs.provisionalAttr(name, context); provisional {
+		return a, fuse.OK
+	}
+	content, virtual, code := fs.virtualOutput("GetAttr", name)
+	if !code.Ok() {
+		return nil, code
+	}
+	a, code = fs.delegate.GetAttr(name, context)
+	if virtual && code.Ok() {
+		return fs.virtualAttr(name, a, content), code
+	}
+	return a, code
 }
 
 func (fs *LambdaFileSystem) OpenDir(name string, context *fuse.Context) (stream []fuse.DirEntry, status fuse.Status) {
-	fs.beforeFileAccess("OpenDir", name)
+	name, status = fs.resolveDir(name)
+	if !status.Ok() {
+		return nil, status
+	}
+	if code := fs.beforeFileAccess("OpenDir", name); !code.Ok() {
+		return nil, code
+	}
+	if fs.reshapesTree() {
+		// listed again rather than cached, for new entries to show up right away
+		fs.dirViews.DropEntry(name)
+		view := fs.dirView(name)
+		return view.listing, view.code
+	}
 	return fs.delegate.OpenDir(name, context)
 }
 
 func (fs *LambdaFileSystem) Open(name string, flags uint32, context *fuse.Context) (fuseFile nodefs.File, status fuse.Status) {
-	fs.beforeFileAccess("Open", name)
-	return fs.delegate.Open(name, flags, context)
+	mountPath := name
+	resolved, status := fs.resolve(name)
+	if !status.Ok() {
+		return nil, status
+	}
+	if resolved.virtual != nil {
+		return fs.openVirtualEntry(resolved, flags, context)
+	}
+	name = resolved.path
+	writing := flags&(syscall.O_WRONLY|syscall.O_RDWR) != 0
+	if !writing {
+		if content, keyed, code := fs.callerContent(name, context); keyed {
+			if !code.Ok() {
+				return nil, code
+			}
+			return fs.openCallerOutput(name, content, context)
+		}
+	}
+	content, virtual, code := fs.virtualOutput("Open", name)
+	if _, _, provisional := fs.mayServeProvisionalAttr(name); provisional && fs.nodeFs != nil {
+		// the attr reported before may be provisional, even when the size was declared the file may be
+		// declined or fail, only the attr is dropped from the kernel cache
+		fs.nodeFs.FileNotify(mountPath, -1, 0)
+	}
+	if !code.Ok() {
+		return nil, code
+	}
+	if fs.OnError == FailOnError {
+		if _, failed := fs.LastError(name); failed {
+			return nil, fuse.EIO
+		}
+	}
+	if writing {
+		if code := fs.materializeVirtualFile("Open", name); !code.Ok() {
+			return nil, code
+		}
+	} else if virtual {
+		return fs.openVirtualFile(name, content, context)
+	}
+	fuseFile, status = fs.delegate.Open(name, flags, context)
+	if status.Ok() && writing {
+		truncated := flags&syscall.O_TRUNC != 0
+		if truncated {
+			fs.markUserWritten(name)
+		}
+		fuseFile = &trackedFile{File: fuseFile, fs: fs, path: name, written: truncated}
+	}
+	return fuseFile, status
 }
 
 func (fs *LambdaFileSystem) Chmod(path string, mode uint32, context *fuse.Context) (code fuse.Status) {
-	fs.beforeFileAccess("Chmod", path)
+	path, code = fs.resolveFile(path)
+	if !code.Ok() {
+		return code
+	}
+	if code := fs.beforeFileAccess("Chmod", path); !code.Ok() {
+		return code
+	}
+	if code := fs.materializeVirtualFile("Chmod", path); !code.Ok() {
+		return code
+	}
 	return fs.delegate.Chmod(path, mode, context)
 }
 
 func (fs *LambdaFileSystem) Chown(path string, uid uint32, gid uint32, context *fuse.Context) (code fuse.Status) {
-	fs.beforeFileAccess("Chown", path)
+	path, code = fs.resolveFile(path)
+	if !code.Ok() {
+		return code
+	}
+	if code := fs.beforeFileAccess("Chown", path); !code.Ok() {
+		return code
+	}
+	if code := fs.materializeVirtualFile("Chown", path); !code.Ok() {
+		return code
+	}
 	return fs.delegate.Chown(path, uid, gid, context)
 }
 
 func (fs *LambdaFileSystem) Truncate(path string, offset uint64, context *fuse.Context) (code fuse.Status) {
-	fs.beforeFileAccess("Truncate", path)
-	return fs.delegate.Truncate(path, offset, context)
+	path, code = fs.resolveFile(path)
+	if !code.Ok() {
+		return code
+	}
+	if code := fs.beforeFileAccess("Truncate", path); !code.Ok() {
+		return code
+	}
+	if code := fs.materializeVirtualFile("Truncate", path); !code.Ok() {
+		return code
+	}
+	code = fs.delegate.Truncate(path, offset, context)
+	if code.Ok() {
+		fs.markUserWritten(path)
+	}
+	return code
 }
 
 func (fs *LambdaFileSystem) Readlink(name string, context *fuse.Context) (out string, code fuse.Status) {
-	fs.beforeFileAccess("Readlink", name)
+	resolved, code := fs.resolve(name)
+	if !code.Ok() {
+		return "", code
+	}
+	if resolved.virtual != nil {
+		return "", fuse.EINVAL
+	}
+	name = resolved.path
+	if code := fs.beforeFileAccess("Readlink", name); !code.Ok() {
+		return "", code
+	}
 	return fs.delegate.Readlink(name, context)
 }
 
 func (fs *LambdaFileSystem) Mknod(name string, mode uint32, dev uint32, context *fuse.Context) (code fuse.Status) {
-	return fs.delegate.Mknod(name, mode, dev, context)
+	name, code = fs.resolveNew(name)
+	if !code.Ok() {
+		return code
+	}
+	code = fs.delegate.Mknod(name, mode, dev, context)
+	if code.Ok() {
+		fs.dropDirView(name)
+		fs.markUserWritten(name)
+	}
+	return code
 }
 
 func (fs *LambdaFileSystem) Mkdir(path string, mode uint32, context *fuse.Context) (code fuse.Status) {
-	return fs.delegate.Mkdir(path, mode, context)
+	path, code = fs.resolveNew(path)
+	if !code.Ok() {
+		return code
+	}
+	code = fs.delegate.Mkdir(path, mode, context)
+	if code.Ok() {
+		fs.dropDirView(path)
+		fs.markUserWritten(path)
+	}
+	return code
 }
 
 // Don't use os.Remove, it removes twice (unlink followed by rmdir).
 func (fs *LambdaFileSystem) Unlink(name string, context *fuse.Context) (code fuse.Status) {
-	fs.beforeFileAccess("Unlink", name)
-	return fs.delegate.Unlink(name, context)
+	name, code = fs.resolveFile(name)
+	if !code.Ok() {
+		return code
+	}
+	if code := fs.beforeFileAccess("Unlink", name); !code.Ok() {
+		return code
+	}
+	code = fs.delegate.Unlink(name, context)
+	if code.Ok() {
+		fs.dropDirView(name)
+		fs.virtualFiles.Remove(name)
+		fs.manifest.Remove(name)
+	}
+	return code
 }
 
 func (fs *LambdaFileSystem) Rmdir(name string, context *fuse.Context) (code fuse.Status) {
-	fs.beforeFileAccess("Rmdir", name)
-	return fs.delegate.Rmdir(name, context)
+	name, code = fs.resolveFile(name)
+	if !code.Ok() {
+		return code
+	}
+	if code := fs.beforeFileAccess("Rmdir", name); !code.Ok() {
+		return code
+	}
+	code = fs.delegate.Rmdir(name, context)
+	if code.Ok() {
+		fs.dropDirView(name)
+		fs.manifest.Remove(name)
+	}
+	return code
 }
 
 func (fs *LambdaFileSystem) Symlink(pointedTo string, linkName string, context *fuse.Context) (code fuse.Status) {
-	fs.beforeFileAccess("Symlink", linkName)
-	return fs.delegate.Symlink(pointedTo, linkName, context)
+	linkName, code = fs.resolveNew(linkName)
+	if !code.Ok() {
+		return code
+	}
+	if code := fs.beforeFileAccess("Symlink", linkName); !code.Ok() {
+		return code
+	}
+	code = fs.delegate.Symlink(pointedTo, linkName, context)
+	if code.Ok() {
+		fs.dropDirView(linkName)
+		fs.markUserWritten(linkName)
+	}
+	return code
 }
 
 func (fs *LambdaFileSystem) Rename(oldPath string, newPath string, context *fuse.Context) (codee fuse.Status) {
-	fs.beforeFileAccess("Rename", oldPath)
-	return fs.delegate.Rename(oldPath, newPath, context)
+	oldSource, codee := fs.resolveFile(oldPath)
+	if !codee.Ok() {
+		return codee
+	}
+	newPath, codee = fs.resolveRenameTarget(oldPath, oldSource, newPath)
+	if !codee.Ok() {
+		return codee
+	}
+	oldPath = oldSource
+	if code := fs.beforeFileAccess("Rename", oldPath); !code.Ok() {
+		return code
+	}
+	if code := fs.materializeVirtualFile("Rename", oldPath); !code.Ok() {
+		return code
+	}
+	dir := false
+	if attr, code := fs.origin.GetAttr(oldPath, nil); code.Ok() && attr.IsDir() {
+		// unionfs copies the sources of the dir into rw as they are, their outputs are to be moved instead
+		dir = true
+		if code := fs.materializeDir("Rename", oldPath); !code.Ok() {
+			return code
+		}
+	}
+	codee = fs.delegate.Rename(oldPath, newPath, context)
+	if codee.Ok() {
+		fs.dropDirView(oldPath)
+		fs.dropDirView(newPath)
+		fs.virtualFiles.Remove(newPath)
+		fs.manifest.Remove(oldPath)
+		fs.markUserWritten(newPath)
+		if dir {
+			fs.renameManifestEntries(oldPath, newPath)
+		}
+	}
+	return codee
+}
+
+// materializeDir writes the output of every file under dir in rw, generating the ones never accessed
+func (fs *LambdaFileSystem) materializeDir(action string, dir string) fuse.Status {
+	code := fuse.OK
+	fs.walkOrigin(dir, func(path string) error {
+		code = fs.beforeFileAccess(action, path)
+		if code.Ok() {
+			code = fs.materializeVirtualFile(action, path)
+		}
+		return statusError(code)
+	})
+	if !code.Ok() {
+		LogError("failed to generate files of renamed dir", "reason", action, "path", dir, "err", code)
+	}
+	return code
+}
+
+// renameManifestEntries moves the entries under oldDir to newDir, the files moved there are no longer generated from a source
+func (fs *LambdaFileSystem) renameManifestEntries(oldDir string, newDir string) {
+	prefix := oldDir + string(filepath.Separator)
+	for _, entry := range fs.manifest.Entries() {
+		if !strings.HasPrefix(entry.Path, prefix) {
+			continue
+		}
+		fs.manifest.Remove(entry.Path)
+		if entry.Origin != OriginDeclined {
+			fs.markUserWritten(filepath.Join(newDir, strings.TrimPrefix(entry.Path, prefix)))
+		}
+	}
 }
 
 func (fs *LambdaFileSystem) Link(orig string, newName string, context *fuse.Context) (code fuse.Status) {
-	fs.beforeFileAccess("Link", newName)
-	return fs.delegate.Link(orig, newName, context)
+	orig, code = fs.resolveFile(orig)
+	if !code.Ok() {
+		return code
+	}
+	newName, code = fs.resolveNew(newName)
+	if !code.Ok() {
+		return code
+	}
+	if code := fs.beforeFileAccess("Link", newName); !code.Ok() {
+		return code
+	}
+	if code := fs.materializeVirtualFile("Link", orig); !code.Ok() {
+		return code
+	}
+	code = fs.delegate.Link(orig, newName, context)
+	if code.Ok() {
+		fs.dropDirView(newName)
+		fs.markUserWritten(newName)
+	}
+	return code
 }
 
 func (fs *LambdaFileSystem) Access(name string, mode uint32, context *fuse.Context) (code fuse.Status) {
-	fs.beforeFileAccess("Access", name)
+	resolved, code := fs.resolve(name)
+	if !code.Ok() {
+		return code
+	}
+	if resolved.virtual != nil {
+		if mode&fuse.W_OK != 0 {
+			return fuse.EACCES
+		}
+		return fuse.OK
+	}
+	name = resolved.path
+	if code := fs.beforeProvisionalAccess("Access", name, context); !code.Ok() {
+		return code
+	}
 	return fs.delegate.Access(name, mode, context)
 }
 
 func (fs *LambdaFileSystem) Create(path string, flags uint32, mode uint32, context *fuse.Context) (fuseFile nodefs.File, code fuse.Status) {
-	return fs.delegate.Create(path, flags, mode, context)
+	path, code = fs.resolveNew(path)
+	if !code.Ok() {
+		return nil, code
+	}
+	fuseFile, code = fs.delegate.Create(path, flags, mode, context)
+	if code.Ok() {
+		fs.dropDirView(path)
+		fs.virtualFiles.Remove(path)
+		fs.markUserWritten(path)
+		fuseFile = &trackedFile{File: fuseFile, fs: fs, path: path, written: true}
+	}
+	return fuseFile, code
 }
 
 func (fs *LambdaFileSystem) GetXAttr(name string, attribute string, context *fuse.Context) (data []byte, code fuse.Status) {
-	fs.beforeFileAccess("GetXAttr", name)
+	resolved, code := fs.resolve(name)
+	if !code.Ok() {
+		return nil, code
+	}
+	if resolved.virtual != nil {
+		return nil, fuse.ENOATTR
+	}
+	name = resolved.path
+	if code := fs.beforeProvisionalAccess("GetXAttr", name, context); !code.Ok() {
+		return nil, code
+	}
+	if attribute == ErrorXAttr {
+		message, failed := fs.LastError(name)
+		if !failed {
+			return nil, fuse.ENOATTR
+		}
+		return []byte(message), fuse.OK
+	}
 	return fs.delegate.GetXAttr(name, attribute, context)
 }
 
 func (fs *LambdaFileSystem)  ListXAttr(name string, context *fuse.Context) (attributes []string, code fuse.Status) {
-	fs.beforeFileAccess("ListXAttr", name)
-	return fs.delegate.ListXAttr(name, context)
+	resolved, code := fs.resolve(name)
+	if !code.Ok() {
+		return nil, code
+	}
+	if resolved.virtual != nil {
+		return nil, fuse.OK
+	}
+	name = resolved.path
+	if code := fs.beforeProvisionalAccess("ListXAttr", name, context); !code.Ok() {
+		return nil, code
+	}
+	attributes, code = fs.delegate.ListXAttr(name, context)
+	if _, failed := fs.LastError(name); failed && (code.Ok() || code == fuse.ENOSYS) {
+		return append(attributes, ErrorXAttr), fuse.OK
+	}
+	return attributes, code
 }
 
 func (fs *LambdaFileSystem)  RemoveXAttr(name string, attr string, context *fuse.Context) fuse.Status {
-	fs.beforeFileAccess("RemoveXAttr", name)
+	name, code := fs.resolveFile(name)
+	if !code.Ok() {
+		return code
+	}
+	if code := fs.beforeFileAccess("RemoveXAttr", name); !code.Ok() {
+		return code
+	}
+	if code := fs.materializeVirtualFile("RemoveXAttr", name); !code.Ok() {
+		return code
+	}
 	return fs.delegate.RemoveXAttr(name, attr, context)
 }
 
 func (fs *LambdaFileSystem) SetXAttr(name string, attr string, data []byte, flags int, context *fuse.Context) fuse.Status {
-	fs.beforeFileAccess("SetXAttr", name)
+	name, code := fs.resolveFile(name)
+	if !code.Ok() {
+		return code
+	}
+	if code := fs.beforeFileAccess("SetXAttr", name); !code.Ok() {
+		return code
+	}
+	if code := fs.materializeVirtualFile("SetXAttr", name); !code.Ok() {
+		return code
+	}
 	return fs.delegate.SetXAttr(name, attr, data, flags, context)
 }
 
@@ -223,6 +970,15 @@ func (fs *LambdaFileSystem) String() string {
 }
 
 func (fs *LambdaFileSystem) Utimens(name string, Atime *time.Time, Mtime *time.Time, context *fuse.Context) (code fuse.Status) {
-	fs.beforeFileAccess("Utimens", name)
+	name, code = fs.resolveFile(name)
+	if !code.Ok() {
+		return code
+	}
+	if code := fs.beforeFileAccess("Utimens", name); !code.Ok() {
+		return code
+	}
+	if code := fs.materializeVirtualFile("Utimens", name); !code.Ok() {
+		return code
+	}
 	return fs.delegate.Utimens(name, Atime, Mtime, context)
 }
\ No newline at end of file
@@ -0,0 +1,266 @@
+package lambdafs
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/hanwen/go-fuse/fuse/pathfs"
+)
+
+// Origin tells how a path of the rw dir came to exist
+type Origin string
+
+const (
+	OriginGenerated Origin = "generated"
+	OriginUser      Origin = "user"
+	OriginDir       Origin = "dir"
+	// an error file written in place of the output of a failed transform
+	OriginError Origin = "error"
+	// no rw copy, the transformer declined the source
+	OriginDeclined Origin = "declined"
+	// no rw copy, the output is kept in memory
+	OriginVirtual Origin = "virtual"
+)
+
+// ManifestEntry describes what lambdafs knows about a path of the rw dir
+type ManifestEntry struct {
+	Path        string
+	Origin      Origin       `json:",omitempty"`
+	Source      *SourceStamp `json:",omitempty"`
+	Transformer string       `json:",omitempty"`
+	Fingerprint string       `json:",omitempty"`
+	Error       string       `json:",omitempty"`
+	// other files the output was generated from, nil stamps for the ones missing then
+	Dependencies map[string]*SourceStamp `json:",omitempty"`
+	Time         time.Time
+	Removed      bool `json:",omitempty"`
+}
+
+// generated tells if lambdafs made the rw copy of the entry, files written through the mount are never generated
+func (entry *ManifestEntry) generated() bool {
+	return entry.Origin == OriginGenerated || entry.Origin == OriginError || entry.Origin == OriginDir
+}
+
+// manifest is kept in memory and persisted as a json lines journal under the hidden dir of the cache,
+// the journal is compacted when opened and whenever it grows too much
+type manifest struct {
+	lock     sync.Mutex
+	fs       pathfs.FileSystem
+	filePath string
+	entries  map[string]*ManifestEntry
+	// the paths of the entries depending on each dependency
+	dependents map[string]map[string]bool
+	journal    *fileWriter
+	appended   int
+}
+
+const manifestFileName = "manifest.jsonl"
+
+func openManifest(fs pathfs.FileSystem, metaDir string) (*manifest, error) {
+	err := mkdirAll(fs, metaDir, 0755)
+	if err != nil {
+		return nil, err
+	}
+	m := &manifest{
+		fs:         fs,
+		filePath:   filepath.Join(metaDir, manifestFileName),
+		entries:    map[string]*ManifestEntry{},
+		dependents: map[string]map[string]bool{},
+	}
+	err = m.load()
+	if err != nil {
+		return nil, err
+	}
+	err = m.compact()
+	if err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (m *manifest) load() error {
+	file, err := openFile(m.fs, m.filePath)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		entry := &ManifestEntry{}
+		err := json.Unmarshal(scanner.Bytes(), entry)
+		if err != nil {
+			// the last line may be cut by a crash
+			LogWarning("skip corrupted manifest line", "file", m.filePath, "err", err)
+			continue
+		}
+		if entry.Removed {
+			m.unset(entry.Path)
+		} else {
+			m.set(entry)
+		}
+	}
+	return scanner.Err()
+}
+
+// compact rewrites the journal with only the live entries
+func (m *manifest) compact() error {
+	tmpPath := m.filePath + ".tmp"
+	file, err := createFile(m.fs, tmpPath, 0644)
+	if err != nil {
+		return err
+	}
+	writer := bufio.NewWriter(file)
+	encoder := json.NewEncoder(writer)
+	for _, entry := range m.entries {
+		err = encoder.Encode(entry)
+		if err != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = writer.Flush()
+	}
+	closeErr := file.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		m.fs.Unlink(tmpPath, nil)
+		return err
+	}
+	err = statusError(m.fs.Rename(tmpPath, m.filePath, nil))
+	if err != nil {
+		return err
+	}
+	if m.journal != nil {
+		m.journal.Close()
+		m.journal = nil
+	}
+	journal, code := m.fs.Open(m.filePath, uint32(os.O_WRONLY), nil)
+	if !code.Ok() {
+		return statusError(code)
+	}
+	m.journal = &fileWriter{file: journal, offset: file.offset}
+	m.appended = 0
+	return nil
+}
+
+func (m *manifest) append(entry *ManifestEntry) {
+	if m.journal == nil {
+		return
+	}
+	line, err := json.Marshal(entry)
+	if err != nil {
+		LogError("failed to marshal manifest entry", "path", entry.Path, "err", err)
+		return
+	}
+	_, err = m.journal.Write(append(line, '\n'))
+	if err != nil {
+		LogError("failed to append manifest", "path", entry.Path, "err", err)
+		return
+	}
+	m.appended++
+	if m.appended > 1024 && m.appended > 2*len(m.entries) {
+		err = m.compact()
+		if err != nil {
+			LogError("failed to compact manifest", "err", err)
+		}
+	}
+}
+
+// set replaces the entry of its path, keeping the dependents index up to date
+func (m *manifest) set(entry *ManifestEntry) {
+	m.unset(entry.Path)
+	m.entries[entry.Path] = entry
+	for dependency := range entry.Dependencies {
+		paths := m.dependents[dependency]
+		if paths == nil {
+			paths = map[string]bool{}
+			m.dependents[dependency] = paths
+		}
+		paths[entry.Path] = true
+	}
+}
+
+func (m *manifest) unset(path string) {
+	entry, found := m.entries[path]
+	if !found {
+		return
+	}
+	delete(m.entries, path)
+	for dependency := range entry.Dependencies {
+		paths := m.dependents[dependency]
+		delete(paths, path)
+		if len(paths) == 0 {
+			delete(m.dependents, dependency)
+		}
+	}
+}
+
+func (m *manifest) Get(path string) *ManifestEntry {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	entry := m.entries[path]
+	if entry == nil {
+		return nil
+	}
+	copied := *entry
+	return &copied
+}
+
+func (m *manifest) Put(entry *ManifestEntry) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	copied := *entry
+	copied.Time = time.Now()
+	m.set(&copied)
+	m.append(&copied)
+}
+
+func (m *manifest) Remove(path string) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if _, found := m.entries[path]; !found {
+		return
+	}
+	m.unset(path)
+	m.append(&ManifestEntry{Path: path, Removed: true, Time: time.Now()})
+}
+
+// Dependents lists the paths of the entries depending on dependency
+func (m *manifest) Dependents(dependency string) []string {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	paths := make([]string, 0, len(m.dependents[dependency]))
+	for path := range m.dependents[dependency] {
+		paths = append(paths, path)
+	}
+	return paths
+}
+
+func (m *manifest) Entries() []ManifestEntry {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	entries := make([]ManifestEntry, 0, len(m.entries))
+	for _, entry := range m.entries {
+		entries = append(entries, *entry)
+	}
+	return entries
+}
+
+func (m *manifest) Close() {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.journal != nil {
+		m.journal.Close()
+		m.journal = nil
+	}
+}
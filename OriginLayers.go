@@ -0,0 +1,137 @@
+package lambdafs
+
+import (
+	"path/filepath"
+
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/hanwen/go-fuse/fuse/nodefs"
+	"github.com/hanwen/go-fuse/fuse/pathfs"
+)
+
+// originLayers is the read-only view of several origins stacked like the ro branches of unionfs,
+// a path is served by the first layer holding it and dir listings are merged
+type originLayers struct {
+	pathfs.FileSystem
+	layers []pathfs.FileSystem
+}
+
+func newOriginLayers(layers []pathfs.FileSystem) pathfs.FileSystem {
+	if len(layers) == 1 {
+		return layers[0]
+	}
+	return &originLayers{FileSystem: pathfs.NewDefaultFileSystem(), layers: layers}
+}
+
+// find returns the index of the first layer holding path
+func (origin *originLayers) find(path string, context *fuse.Context) (int, *fuse.Attr, fuse.Status) {
+	for i, layer := range origin.layers {
+		attr, code := layer.GetAttr(path, context)
+		if code == fuse.ENOENT {
+			continue
+		}
+		return i, attr, code
+	}
+	return 0, nil, fuse.ENOENT
+}
+
+func (origin *originLayers) layerOf(path string) pathfs.FileSystem {
+	i, _, _ := origin.find(path, nil)
+	return origin.layers[i]
+}
+
+func (origin *originLayers) String() string {
+	return "originLayers"
+}
+
+func (origin *originLayers) GetAttr(path string, context *fuse.Context) (*fuse.Attr, fuse.Status) {
+	_, attr, code := origin.find(path, context)
+	return attr, code
+}
+
+func (origin *originLayers) Access(path string, mode uint32, context *fuse.Context) fuse.Status {
+	return origin.layerOf(path).Access(path, mode, context)
+}
+
+func (origin *originLayers) Readlink(path string, context *fuse.Context) (string, fuse.Status) {
+	return origin.layerOf(path).Readlink(path, context)
+}
+
+func (origin *originLayers) GetXAttr(path string, attribute string, context *fuse.Context) ([]byte, fuse.Status) {
+	return origin.layerOf(path).GetXAttr(path, attribute, context)
+}
+
+func (origin *originLayers) ListXAttr(path string, context *fuse.Context) ([]string, fuse.Status) {
+	return origin.layerOf(path).ListXAttr(path, context)
+}
+
+func (origin *originLayers) Open(path string, flags uint32, context *fuse.Context) (nodefs.File, fuse.Status) {
+	if flags&fuse.O_ANYWRITE != 0 {
+		return nil, fuse.EROFS
+	}
+	return origin.layerOf(path).Open(path, flags, context)
+}
+
+// OpenDir lists the dir in every layer holding it, a name is listed once with the mode of the first layer
+func (origin *originLayers) OpenDir(path string, context *fuse.Context) ([]fuse.DirEntry, fuse.Status) {
+	var listing []fuse.DirEntry
+	seen := map[string]bool{}
+	found := false
+	for _, layer := range origin.layers {
+		entries, code := layer.OpenDir(path, context)
+		if !code.Ok() {
+			continue
+		}
+		found = true
+		for _, entry := range entries {
+			if seen[entry.Name] {
+				continue
+			}
+			seen[entry.Name] = true
+			listing = append(listing, entry)
+		}
+	}
+	if !found {
+		return nil, fuse.ENOENT
+	}
+	return listing, fuse.OK
+}
+
+func (origin *originLayers) StatFs(path string) *fuse.StatfsOut {
+	return origin.layers[0].StatFs(path)
+}
+
+// statSource stats path in origin, telling which of its layers holds it, a missing path belongs to the first layer
+func statSource(origin pathfs.FileSystem, path string) (*fuse.Attr, int, error) {
+	if layers, ok := origin.(*originLayers); ok {
+		layer, attr, code := layers.find(path, nil)
+		return attr, layer, statusError(code)
+	}
+	attr, err := getAttr(origin, path)
+	return attr, 0, err
+}
+
+// originLayer is the origin layer of the given index, as told by statSource
+func (fs *LambdaFileSystem) originLayer(layer int) pathfs.FileSystem {
+	if layers, ok := fs.origin.(*originLayers); ok {
+		return layers.layers[layer]
+	}
+	return fs.origin
+}
+
+// sourceFilePath is the path given to transformers for the source of path in layer,
+// a local file path when the origin is made of local dirs
+func (fs *LambdaFileSystem) sourceFilePath(path string, layer int) string {
+	if len(fs.origDirs) == 0 {
+		return path
+	}
+	return filepath.Join(fs.origDirs[layer], path)
+}
+
+// sourceFilePathOf is the path given to transformers for the source of path, in whichever layer holds it
+func (fs *LambdaFileSystem) sourceFilePathOf(path string) string {
+	if len(fs.origDirs) <= 1 {
+		return fs.sourceFilePath(path, 0)
+	}
+	_, layer, _ := statSource(fs.origin, path)
+	return fs.sourceFilePath(path, layer)
+}
@@ -0,0 +1,120 @@
+package lambdafs
+
+import (
+	"strings"
+	"time"
+
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/hanwen/go-fuse/fuse/pathfs"
+)
+
+// Moder is implemented by transformers choosing the permission bits of their output,
+// generated files take the ones of their source otherwise.
+// filePath is the source file, as given to Transformer.Transform
+type Moder interface {
+	OutputMode(filePath string, sourceMode uint32) uint32
+}
+
+type modedTransformer struct {
+	Transformer
+	mode func(sourceMode uint32) uint32
+}
+
+// WithMode gives the output of transformer the permission bits mode, whatever the ones of the source
+func WithMode(mode uint32, transformer Transformer) Transformer {
+	return &modedTransformer{Transformer: transformer, mode: func(uint32) uint32 {
+		return mode
+	}}
+}
+
+// Executable makes the output of transformer executable by whoever can read the source, like a generated script
+func Executable(transformer Transformer) Transformer {
+	return &modedTransformer{Transformer: transformer, mode: func(sourceMode uint32) uint32 {
+		return sourceMode | (sourceMode&0444)>>2
+	}}
+}
+
+func (transformer *modedTransformer) OutputMode(filePath string, sourceMode uint32) uint32 {
+	return transformer.mode(sourceMode)
+}
+
+func (transformer *modedTransformer) Unwrap() Transformer {
+	return transformer.Transformer
+}
+
+func moderOf(transformer Transformer) Moder {
+	moder, _ := lookupCapability(transformer, func(transformer Transformer) bool {
+		_, ok := transformer.(Moder)
+		return ok
+	}).(Moder)
+	return moder
+}
+
+// outputMode is the permission bits of the output of transformer for the source filePath, sourceMode may hold the file type too
+func outputMode(filePath string, transformer Transformer, sourceMode uint32) uint32 {
+	mode := sourceMode & 07777
+	if moder := moderOf(transformer); moder != nil {
+		mode = moder.OutputMode(filePath, mode) & 07777
+	}
+	return mode
+}
+
+// the xattrs copied from the source to generated files
+const copiedXAttrPrefix = "user."
+
+// outputMetadata is what a generated file inherits from its source
+type outputMetadata struct {
+	mode    uint32
+	owner   fuse.Owner
+	modTime time.Time
+	xattrs  map[string][]byte
+}
+
+// sourceMetadata collects the metadata of the source of path given its attr, the permission bits are replaced by mode
+func (fs *LambdaFileSystem) sourceMetadata(path string, attr *fuse.Attr, mode uint32) *outputMetadata {
+	meta := &outputMetadata{
+		mode:    mode,
+		owner:   attr.Owner,
+		modTime: attr.ModTime(),
+	}
+	names, code := fs.origin.ListXAttr(path, nil)
+	if !code.Ok() {
+		return meta
+	}
+	for _, name := range names {
+		if !strings.HasPrefix(name, copiedXAttrPrefix) || name == ErrorXAttr {
+			continue
+		}
+		value, code := fs.origin.GetXAttr(path, name, nil)
+		if !code.Ok() {
+			continue
+		}
+		if meta.xattrs == nil {
+			meta.xattrs = map[string][]byte{}
+		}
+		meta.xattrs[name] = value
+	}
+	return meta
+}
+
+// apply gives path of cache the metadata, the owner and xattrs are left out where the cache does not allow them
+func (meta *outputMetadata) apply(cache pathfs.FileSystem, path string) error {
+	for name, value := range meta.xattrs {
+		code := cache.SetXAttr(path, name, value, 0, nil)
+		if !code.Ok() && ShouldLogDebug() {
+			LogDebug("failed to copy xattr", "path", path, "xattr", name, "err", code)
+		}
+	}
+	// only privileged processes can give files away, before chmod as chown clears setuid bits
+	code := cache.Chown(path, meta.owner.Uid, meta.owner.Gid, nil)
+	if !code.Ok() && code != fuse.EPERM && ShouldLogDebug() {
+		LogDebug("failed to copy owner", "path", path, "err", code)
+	}
+	err := statusError(cache.Chmod(path, meta.mode, nil))
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	cache.Utimens(path, &now, &meta.modTime, nil)
+	return nil
+}
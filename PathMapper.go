@@ -0,0 +1,87 @@
+package lambdafs
+
+import (
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+// PathMapper maps paths shown through the mount to the paths of their source and back,
+// only the base name may differ. Sources are looked up through the listing of their dir,
+// so a source shown under another name is not reachable by its own name.
+type PathMapper interface {
+	// SourcePath is the path a file created as mountPath by renaming a mapped file is stored as
+	SourcePath(mountPath string) string
+	// MountPath is the path sourcePath is shown as
+	MountPath(sourcePath string) string
+}
+
+// ExtensionMapper shows files with a source extension under another one, like ".ts" as ".js"
+type ExtensionMapper map[string]string
+
+func (mapper ExtensionMapper) SourcePath(mountPath string) string {
+	sourceExts := make([]string, 0, len(mapper))
+	for sourceExt := range mapper {
+		sourceExts = append(sourceExts, sourceExt)
+	}
+	sort.Strings(sourceExts)
+	for _, sourceExt := range sourceExts {
+		mountExt := mapper[sourceExt]
+		if strings.HasSuffix(mountPath, mountExt) {
+			return strings.TrimSuffix(mountPath, mountExt) + sourceExt
+		}
+	}
+	return mountPath
+}
+
+func (mapper ExtensionMapper) MountPath(sourcePath string) string {
+	sourceExt := filepath.Ext(sourcePath)
+	mountExt, found := mapper[sourceExt]
+	if !found {
+		return sourcePath
+	}
+	return strings.TrimSuffix(sourcePath, sourceExt) + mountExt
+}
+
+// mapDirEntries shows entries under their mount name,
+// an entry already named that way wins over the mapped one
+func (fs *LambdaFileSystem) mapDirEntries(entries []DirEntry) []DirEntry {
+	names := map[string]bool{}
+	for _, entry := range entries {
+		names[entry.Name] = true
+	}
+	mapped := make([]DirEntry, 0, len(entries))
+	for _, entry := range entries {
+		name := filepath.Base(fs.PathMapper.MountPath(entry.Source))
+		if name != entry.Name {
+			if names[name] {
+				if ShouldLogDebug() {
+					LogDebug("mapped name already taken", "path", entry.Source, "name", name)
+				}
+				continue
+			}
+			entry.Name = name
+		}
+		mapped = append(mapped, entry)
+	}
+	return mapped
+}
+
+// resolveRenameTarget keeps a mapped file mapped once renamed to a new name,
+// otherwise the new name is used as is
+func (fs *LambdaFileSystem) resolveRenameTarget(oldPath string, oldSource string, newPath string) (string, fuse.Status) {
+	if fs.PathMapper == nil || filepath.Base(oldSource) == filepath.Base(oldPath) {
+		return fs.resolveNew(newPath)
+	}
+	if _, code := fs.resolve(newPath); code.Ok() {
+		// replaces an existing file
+		return fs.resolveNew(newPath)
+	}
+	parent, code := fs.resolveDir(filepath.Dir(newPath))
+	if !code.Ok() {
+		return "", code
+	}
+	return filepath.Join(parent, filepath.Base(fs.PathMapper.SourcePath(newPath))), fuse.OK
+}
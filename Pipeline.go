@@ -0,0 +1,204 @@
+package lambdafs
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+// Pipeline is a Transformer running several stages in order,
+// each stage reads the output of the previous one.
+// If any stage returns ErrSkipFile, the whole file is left untransformed.
+type Pipeline struct {
+	stages []pipelineStage
+}
+
+type pipelineStage struct {
+	name        string
+	transformer Transformer
+}
+
+func NewPipeline() *Pipeline {
+	return &Pipeline{}
+}
+
+// Then appends a stage, the name is used to report failures
+func (pipeline *Pipeline) Then(name string, transformer Transformer) *Pipeline {
+	pipeline.stages = append(pipeline.stages, pipelineStage{name: name, transformer: transformer})
+	return pipeline
+}
+
+// Fingerprint changes whenever a stage is added, removed, renamed or changes its own fingerprint
+func (pipeline *Pipeline) Fingerprint() string {
+	parts := make([]string, 0, len(pipeline.stages))
+	for _, stage := range pipeline.stages {
+		parts = append(parts, stage.name+"="+fingerprintOf(stage.transformer))
+	}
+	return strings.Join(parts, ";")
+}
+
+// inverse runs the inverse of every stage in reverse order, nil if a stage can not be inverted
+func (pipeline *Pipeline) inverse() Transformer {
+	inverse := NewPipeline()
+	for i := len(pipeline.stages) - 1; i >= 0; i-- {
+		stage := pipeline.stages[i]
+		stageInverse := inverseOf(stage.transformer)
+		if stageInverse == nil {
+			return nil
+		}
+		inverse.Then(stage.name+" (inverse)", stageInverse)
+	}
+	return inverse
+}
+
+// OutputSize is known when every stage declares its output size
+func (pipeline *Pipeline) OutputSize(filePath string, sourceSize int64) (int64, bool) {
+	size := sourceSize
+	for _, stage := range pipeline.stages {
+		sizer := sizerOf(stage.transformer)
+		if sizer == nil {
+			return 0, false
+		}
+		var known bool
+		size, known = sizer.OutputSize(filePath, size)
+		if !known {
+			return 0, false
+		}
+	}
+	return size, true
+}
+
+// OutputMode passes the mode through every stage choosing one
+func (pipeline *Pipeline) OutputMode(filePath string, sourceMode uint32) uint32 {
+	mode := sourceMode
+	for _, stage := range pipeline.stages {
+		if moder := moderOf(stage.transformer); moder != nil {
+			mode = moder.OutputMode(filePath, mode)
+		}
+	}
+	return mode
+}
+
+// keyed tells if the output of any stage depends on the caller
+func (pipeline *Pipeline) keyed() bool {
+	for _, stage := range pipeline.stages {
+		if keyerOf(stage.transformer) != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// CacheKey joins the keys of the stages depending on the caller
+func (pipeline *Pipeline) CacheKey(filePath string, caller *fuse.Context) string {
+	parts := make([]string, 0, len(pipeline.stages))
+	for _, stage := range pipeline.stages {
+		if keyer := keyerOf(stage.transformer); keyer != nil {
+			parts = append(parts, stage.name+"="+keyer.CacheKey(filePath, caller))
+		}
+	}
+	return strings.Join(parts, ";")
+}
+
+var errStageAborted = errors.New("lambdafs: downstream stage aborted")
+
+type stageResult struct {
+	err              error
+	upstreamFailed   bool
+	downstreamFailed bool
+}
+
+// stageReader remembers if the stage saw an error propagated from the upstream stage
+type stageReader struct {
+	reader io.Reader
+	result *stageResult
+}
+
+func (r *stageReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	if err != nil && err != io.EOF {
+		r.result.upstreamFailed = true
+	}
+	return n, err
+}
+
+// stageWriter remembers if the stage was aborted by the downstream stage
+type stageWriter struct {
+	writer io.Writer
+	result *stageResult
+}
+
+func (w *stageWriter) Write(p []byte) (int, error) {
+	n, err := w.writer.Write(p)
+	if err == errStageAborted {
+		w.result.downstreamFailed = true
+	}
+	return n, err
+}
+
+func (pipeline *Pipeline) Transform(filePath string, src io.Reader, dst io.Writer) error {
+	return pipeline.transform(nil, filePath, src, dst)
+}
+
+// TransformWithContext passes ctx to the stages taking one
+func (pipeline *Pipeline) TransformWithContext(ctx *TransformContext, src io.Reader, dst io.Writer) error {
+	return pipeline.transform(ctx, ctx.FilePath, src, dst)
+}
+
+func (pipeline *Pipeline) transform(ctx *TransformContext, filePath string, src io.Reader, dst io.Writer) error {
+	if len(pipeline.stages) == 0 {
+		_, err := io.Copy(dst, src)
+		return err
+	}
+	results := make([]stageResult, len(pipeline.stages))
+	done := make(chan struct{}, len(pipeline.stages))
+	input := src
+	last := len(pipeline.stages) - 1
+	for i := 0; i < last; i++ {
+		reader, writer := io.Pipe()
+		go func(i int, input io.Reader, writer *io.PipeWriter) {
+			results[i].err = pipeline.runStage(ctx, i, &results[i], filePath, input, writer)
+			writer.CloseWithError(results[i].err)
+			done <- struct{}{}
+		}(i, input, writer)
+		input = reader
+	}
+	results[last].err = pipeline.runStage(ctx, last, &results[last], filePath, input, dst)
+	for i := 0; i < last; i++ {
+		<-done
+	}
+	for i, result := range results {
+		if result.err == ErrSkipFile {
+			return ErrSkipFile
+		}
+		if result.err == nil || result.upstreamFailed || result.downstreamFailed {
+			continue
+		}
+		name := pipeline.stages[i].name
+		LogError("transform stage failed", "stage", name, "path", filePath, "err", result.err)
+		return fmt.Errorf("stage %s: %v", name, result.err)
+	}
+	for _, result := range results {
+		if result.err != nil {
+			return result.err
+		}
+	}
+	return nil
+}
+
+func (pipeline *Pipeline) runStage(ctx *TransformContext, i int, result *stageResult, filePath string, input io.Reader, output io.Writer) error {
+	err := transformWith(ctx, pipeline.stages[i].transformer, filePath,
+		&stageReader{reader: input, result: result}, &stageWriter{writer: output, result: result})
+	if pipeReader, ok := input.(*io.PipeReader); ok {
+		if err == nil {
+			io.Copy(ioutil.Discard, pipeReader) // let the upstream stage finish
+		} else {
+			pipeReader.CloseWithError(errStageAborted)
+		}
+	}
+	return err
+}
@@ -0,0 +1,117 @@
+package lambdafs
+
+import (
+	"errors"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+// foregroundGate counts accesses coming from the mount, background work waits for them to finish
+type foregroundGate struct {
+	lock   sync.Mutex
+	idle   *sync.Cond
+	active int
+}
+
+func (gate *foregroundGate) init() {
+	gate.idle = sync.NewCond(&gate.lock)
+}
+
+func (gate *foregroundGate) Enter() {
+	gate.lock.Lock()
+	gate.active++
+	gate.lock.Unlock()
+}
+
+func (gate *foregroundGate) Leave() {
+	gate.lock.Lock()
+	gate.active--
+	if gate.active == 0 {
+		gate.idle.Broadcast()
+	}
+	gate.lock.Unlock()
+}
+
+func (gate *foregroundGate) WaitIdle() {
+	gate.lock.Lock()
+	for gate.active > 0 {
+		gate.idle.Wait()
+	}
+	gate.lock.Unlock()
+}
+
+const prewarmProgressInterval = 1000
+
+var errPrewarmStopped = errors.New("lambdafs: prewarm stopped")
+
+// Prewarm walks the origin and brings the rw copy of every file up to date with parallelism workers,
+// a worker only picks the next file when no access from the mount is in progress.
+// It returns when the walk is done or the file system is unmounted.
+func (fs *LambdaFileSystem) Prewarm(parallelism int) {
+	if parallelism < 1 {
+		parallelism = 1
+	}
+	started := time.Now()
+	paths := make(chan string)
+	go func() {
+		defer close(paths)
+		fs.walkOrigin("", func(path string) error {
+			select {
+			case paths <- path:
+				return nil
+			case <-fs.unmounted:
+				return errPrewarmStopped
+			}
+		})
+	}()
+	var lock sync.Mutex
+	done := 0
+	var workers sync.WaitGroup
+	for i := 0; i < parallelism; i++ {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			for path := range paths {
+				fs.foreground.WaitIdle()
+				fs.flights.Do(path, func() fuse.Status {
+					return fs.syncRwPath("Prewarm", path)
+				})
+				lock.Lock()
+				done++
+				if done%prewarmProgressInterval == 0 {
+					LogInfo("prewarm in progress", "files", done, "elapsed", time.Since(started))
+				}
+				lock.Unlock()
+			}
+		}()
+	}
+	workers.Wait()
+	LogInfo("prewarm finished", "files", done, "elapsed", time.Since(started))
+}
+
+// walkOrigin calls visit with every path under dir in the origin, parents first
+func (fs *LambdaFileSystem) walkOrigin(dir string, visit func(path string) error) error {
+	entries, code := fs.origin.OpenDir(dir, nil)
+	if !code.Ok() {
+		LogWarning("failed to walk origin", "path", dir, "err", code)
+		return nil
+	}
+	for _, entry := range entries {
+		path := filepath.Join(dir, entry.Name)
+		err := visit(path)
+		if err != nil {
+			return err
+		}
+		if entry.Mode&syscall.S_IFMT == syscall.S_IFDIR {
+			err = fs.walkOrigin(path, visit)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,107 @@
+package lambdafs
+
+import (
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+// Sizer is implemented by transformers knowing the size of their output without transforming,
+// GetAttr then reports it and leaves the transform to the first open.
+// Returning false means the size of that file is unknown.
+// filePath is the source file, as given to Transformer.Transform.
+type Sizer interface {
+	OutputSize(filePath string, sourceSize int64) (int64, bool)
+}
+
+type sizedTransformer struct {
+	Transformer
+	delta int64
+}
+
+// SameSize declares transformer outputs as many bytes as it reads
+func SameSize(transformer Transformer) Transformer {
+	return SizeDelta(0, transformer)
+}
+
+// SizeDelta declares transformer outputs delta bytes more than it reads, like appending a fixed suffix
+func SizeDelta(delta int64, transformer Transformer) Transformer {
+	return &sizedTransformer{Transformer: transformer, delta: delta}
+}
+
+func (transformer *sizedTransformer) OutputSize(filePath string, sourceSize int64) (int64, bool) {
+	return sourceSize + transformer.delta, true
+}
+
+func (transformer *sizedTransformer) Unwrap() Transformer {
+	return transformer.Transformer
+}
+
+func sizerOf(transformer Transformer) Sizer {
+	sizer, _ := lookupCapability(transformer, func(transformer Transformer) bool {
+		_, ok := transformer.(Sizer)
+		return ok
+	}).(Sizer)
+	return sizer
+}
+
+// mayServeProvisionalAttr tells if GetAttr may report path before it is transformed,
+// the kernel then has to forget that attr once the file is opened
+func (fs *LambdaFileSystem) mayServeProvisionalAttr(path string) (Transformer, Sizer, bool) {
+	if !fs.hasTransformers() || fs.isMetaPath(path) {
+		return nil, nil, false
+	}
+	_, transformer := fs.transformerFor(path)
+	if transformer == nil || keyerOf(transformer) != nil {
+		return nil, nil, false
+	}
+	sizer := sizerOf(transformer)
+	return transformer, sizer, sizer != nil || fs.LazyGetAttr
+}
+
+// provisionalAttr reports the attr of a file not transformed yet without transforming it,
+// the size is the declared one, or with LazyGetAttr the one of the source when nothing is declared.
+// Files already transformed, declined or failed are left to the regular GetAttr.
+func (fs *LambdaFileSystem) provisionalAttr(path string, context *fuse.Context) (*fuse.Attr, bool) {
+	transformer, sizer, provisional := fs.mayServeProvisionalAttr(path)
+	if !provisional {
+		return nil, false
+	}
+	if _, err := getAttr(fs.cache, path); err == nil {
+		return nil, false
+	}
+	if fs.VirtualFiles && fs.virtualFiles.Has(path) {
+		return nil, false
+	}
+	entry := fs.manifest.Get(path)
+	if entry != nil && (entry.Origin == OriginDeclined || entry.Origin == OriginError) {
+		return nil, false
+	}
+	attr, code := fs.delegate.GetAttr(path, context)
+	if !code.Ok() || !attr.IsRegular() {
+		return nil, false
+	}
+	filePath := fs.sourceFilePathOf(path)
+	if sizer != nil {
+		size, known := sizer.OutputSize(filePath, int64(attr.Size))
+		if !known && !fs.LazyGetAttr {
+			return nil, false
+		}
+		if known {
+			attr.Size = uint64(size)
+			attr.Blocks = (attr.Size + 511) / 512
+		}
+	}
+	attr.Mode = attr.Mode&^07777 | outputMode(filePath, transformer, attr.Mode)
+	if ShouldLogTrace() {
+		LogTrace("provisional attr", "path", path, "size", attr.Size)
+	}
+	return attr, true
+}
+
+// beforeProvisionalAccess brings path up to date unless GetAttr would report it provisionally,
+// the source then answers and the transform is left to the first open
+func (fs *LambdaFileSystem) beforeProvisionalAccess(action string, path string, context *fuse.Context) fuse.Status {
+	if _, provisional := fs.provisionalAttr(path, context); provisional {
+		return fuse.OK
+	}
+	return fs.beforeFileAccess(action, path)
+}
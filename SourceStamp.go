@@ -0,0 +1,172 @@
+package lambdafs
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"hash"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/hanwen/go-fuse/fuse/pathfs"
+)
+
+type InvalidationMode int
+
+const (
+	// regenerate when the source is modified after the rw copy
+	InvalidateByModTime InvalidationMode = iota
+	// regenerate when the source content hash differs from the one recorded with the rw copy,
+	// the hash is only computed when size, inode or mtime changed
+	InvalidateByContentHash
+)
+
+// the hidden dir under tempDir holding lambdafs own data
+const metaDirName = ".lambdafs"
+
+// SourceStamp identifies the source content a rw copy was generated from
+type SourceStamp struct {
+	Size    int64
+	Ino     uint64
+	ModTime time.Time
+	// index of the origin layer holding the source
+	Layer int    `json:",omitempty"`
+	Hash  string `json:",omitempty"`
+}
+
+func newSourceStamp(attr *fuse.Attr, layer int) *SourceStamp {
+	return &SourceStamp{
+		Size:    int64(attr.Size),
+		Ino:     attr.Ino,
+		ModTime: attr.ModTime(),
+		Layer:   layer,
+	}
+}
+
+func (stamp *SourceStamp) sameFileInfo(other *SourceStamp) bool {
+	return stamp.Size == other.Size && stamp.Ino == other.Ino && stamp.ModTime.Equal(other.ModTime) && stamp.Layer == other.Layer
+}
+
+func newContentHash() hash.Hash {
+	return sha256.New()
+}
+
+func formatContentHash(hasher hash.Hash) string {
+	return hex.EncodeToString(hasher.Sum(nil))
+}
+
+func hashFile(fs pathfs.FileSystem, path string) (string, error) {
+	file, err := openFile(fs, path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	hasher := newContentHash()
+	_, err = io.Copy(hasher, file)
+	if err != nil {
+		return "", err
+	}
+	return formatContentHash(hasher), nil
+}
+
+func (fs *LambdaFileSystem) isMetaPath(path string) bool {
+	return path == metaDirName || strings.HasPrefix(path, metaDirName+"/")
+}
+
+// isFresh tells if the rw copy of path, or the decision to decline it, still matches its source, dependencies and transformer.
+// Without a source stamp in the manifest, the mtime of the rw copy is compared, rwAttr is nil if there is none.
+// A source now coming from another origin layer is always stale.
+func (fs *LambdaFileSystem) isFresh(path string, source *SourceStamp, rwAttr *fuse.Attr, entry *ManifestEntry, fingerprint string) bool {
+	return fs.sourceFresh(path, source, rwAttr, entry, fingerprint) && (entry == nil || fs.dependenciesFresh(entry))
+}
+
+func (fs *LambdaFileSystem) sourceFresh(path string, source *SourceStamp, rwAttr *fuse.Attr, entry *ManifestEntry, fingerprint string) bool {
+	if entry == nil || entry.Source == nil {
+		return rwAttr != nil && !source.ModTime.After(rwAttr.ModTime())
+	}
+	if entry.Fingerprint != fingerprint {
+		return false
+	}
+	stamp := entry.Source
+	if stamp.Layer != source.Layer {
+		return false
+	}
+	if fs.Invalidation != InvalidateByContentHash || stamp.Hash == "" {
+		return !source.ModTime.After(stamp.ModTime)
+	}
+	current := *source
+	if current.sameFileInfo(stamp) {
+		return true
+	}
+	if current.Size != stamp.Size {
+		return false
+	}
+	contentHash, err := hashFile(fs.origin, path)
+	if err != nil {
+		LogError("failed to hash source", "path", path, "err", err)
+		return false
+	}
+	if contentHash != stamp.Hash {
+		return false
+	}
+	// same content, remember the new mtime and inode to skip hashing next time
+	current.Hash = contentHash
+	entry.Source = &current
+	fs.manifest.Put(entry)
+	return true
+}
+
+// PurgeStaleOutputs removes every generated rw copy, virtual file, error file and declined decision whose fingerprint
+// differs from the one of the transformer now registered for its path
+func (fs *LambdaFileSystem) PurgeStaleOutputs() {
+	purged := 0
+	for _, entry := range fs.manifest.Entries() {
+		if entry.Origin != OriginGenerated && entry.Origin != OriginError && entry.Origin != OriginDeclined && entry.Origin != OriginVirtual {
+			continue
+		}
+		_, transformer := fs.transformerFor(entry.Path)
+		if transformer != nil && fingerprintOf(transformer) == entry.Fingerprint {
+			continue
+		}
+		if entry.Origin != OriginDeclined {
+			fs.cache.Unlink(entry.Path, nil)
+			fs.dropBranchCache(entry.Path)
+		}
+		fs.virtualFiles.Remove(entry.Path)
+		fs.manifest.Remove(entry.Path)
+		purged++
+		if ShouldLogDebug() {
+			LogDebug("purged stale output", "path", entry.Path, "fingerprint", entry.Fingerprint)
+		}
+	}
+	LogInfo("purged stale outputs", "count", purged)
+}
+
+// collectOrphan cleans up after the source of path is gone.
+// Only what lambdafs generated is removed, a rw file without a manifest entry or written through the mount is kept.
+func (fs *LambdaFileSystem) collectOrphan(path string, rwPathExists bool) {
+	entry := fs.manifest.Get(path)
+	fs.virtualFiles.Remove(path)
+	fs.transformErrors.Clear(path)
+	if entry == nil {
+		return
+	}
+	if !rwPathExists {
+		// forget the decision to decline it
+		fs.manifest.Remove(path)
+		return
+	}
+	if !entry.generated() {
+		return
+	}
+	if entry.Origin == OriginDir {
+		// a dir still holding files written through the mount stays
+		fs.cache.Rmdir(path, nil)
+	} else {
+		fs.cache.Unlink(path, nil)
+	}
+	fs.manifest.Remove(path)
+	fs.dropBranchCache(path)
+	LogInfo("deleted file", "path", path)
+}
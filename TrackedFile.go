@@ -0,0 +1,69 @@
+package lambdafs
+
+import (
+	"sync"
+
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/hanwen/go-fuse/fuse/nodefs"
+)
+
+// trackedFile marks its path as user written in the manifest on the first successful write,
+// in write back mode the edit is turned back into the source on release
+type trackedFile struct {
+	nodefs.File
+	fs      *LambdaFileSystem
+	path    string
+	lock    sync.Mutex
+	written bool
+}
+
+func (file *trackedFile) markWritten() {
+	file.lock.Lock()
+	defer file.lock.Unlock()
+	if file.written {
+		return
+	}
+	file.written = true
+	file.fs.markUserWritten(file.path)
+}
+
+func (file *trackedFile) Release() {
+	file.File.Release()
+	file.lock.Lock()
+	written := file.written
+	file.lock.Unlock()
+	if written && file.fs.WriteBack {
+		file.fs.flights.Run(file.path, func() fuse.Status {
+			file.fs.writeBack(file.path)
+			return fuse.OK
+		})
+	}
+}
+
+func (file *trackedFile) InnerFile() nodefs.File {
+	return file.File
+}
+
+func (file *trackedFile) Write(data []byte, off int64) (uint32, fuse.Status) {
+	written, code := file.File.Write(data, off)
+	if code.Ok() {
+		file.markWritten()
+	}
+	return written, code
+}
+
+func (file *trackedFile) Truncate(size uint64) fuse.Status {
+	code := file.File.Truncate(size)
+	if code.Ok() {
+		file.markWritten()
+	}
+	return code
+}
+
+func (file *trackedFile) Allocate(off uint64, size uint64, mode uint32) fuse.Status {
+	code := file.File.Allocate(off, size, mode)
+	if code.Ok() {
+		file.markWritten()
+	}
+	return code
+}
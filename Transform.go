@@ -0,0 +1,135 @@
+package lambdafs
+
+import (
+	"errors"
+	"io"
+)
+
+// ErrSkipFile is returned by a transform to leave the file untransformed
+var ErrSkipFile = errors.New("lambdafs: skip file")
+
+// TransformFunc streams the transformed content of the file at filePath from src to dst
+type TransformFunc func(filePath string, src io.Reader, dst io.Writer) error
+
+// AdaptUpdateFile turns a whole-file UpdateFile callback into a TransformFunc,
+// a nil content is reported as ErrSkipFile
+func AdaptUpdateFile(updateFile func(filePath string) ([]byte, error)) TransformFunc {
+	return func(filePath string, src io.Reader, dst io.Writer) error {
+		content, err := updateFile(filePath)
+		if err != nil {
+			return err
+		}
+		if content == nil {
+			return ErrSkipFile
+		}
+		_, err = dst.Write(content)
+		return err
+	}
+}
+
+// Transformer rewrites the content of a source file while it is copied into the rw dir
+type Transformer interface {
+	Transform(filePath string, src io.Reader, dst io.Writer) error
+}
+
+func (f TransformFunc) Transform(filePath string, src io.Reader, dst io.Writer) error {
+	return f(filePath, src, dst)
+}
+
+// Fingerprinter is implemented by transformers declaring a version of their logic,
+// a rw copy generated under another fingerprint is considered stale
+type Fingerprinter interface {
+	Fingerprint() string
+}
+
+// wrapper is implemented by transformers only decorating another one with extra properties
+type wrapper interface {
+	Unwrap() Transformer
+}
+
+type versionedTransformer struct {
+	Transformer
+	version string
+}
+
+// Versioned declares the fingerprint of transformer
+func Versioned(version string, transformer Transformer) Transformer {
+	return &versionedTransformer{Transformer: transformer, version: version}
+}
+
+func (transformer *versionedTransformer) Fingerprint() string {
+	return transformer.version
+}
+
+func (transformer *versionedTransformer) Unwrap() Transformer {
+	return transformer.Transformer
+}
+
+// lookupCapability returns the first of transformer and the transformers it wraps for which has is true, nil if none.
+// A Pipeline is not a wrapper, it has a capability when it implements it for the stages it runs.
+func lookupCapability(transformer Transformer, has func(transformer Transformer) bool) Transformer {
+	for transformer != nil {
+		if has(transformer) {
+			return transformer
+		}
+		wrapped, ok := transformer.(wrapper)
+		if !ok {
+			break
+		}
+		transformer = wrapped.Unwrap()
+	}
+	return nil
+}
+
+func fingerprintOf(transformer Transformer) string {
+	fingerprinter, ok := lookupCapability(transformer, func(transformer Transformer) bool {
+		_, ok := transformer.(Fingerprinter)
+		return ok
+	}).(Fingerprinter)
+	if !ok {
+		return ""
+	}
+	return fingerprinter.Fingerprint()
+}
+
+// Inverter is implemented by transformers able to turn their output back into the source format
+type Inverter interface {
+	Inverse(filePath string, src io.Reader, dst io.Writer) error
+}
+
+type reversibleTransformer struct {
+	Transformer
+	inverse Transformer
+}
+
+// Reversible declares inverse as the transformer turning the output of transformer back into its source
+func Reversible(transformer Transformer, inverse Transformer) Transformer {
+	return &reversibleTransformer{Transformer: transformer, inverse: inverse}
+}
+
+func (transformer *reversibleTransformer) Inverse(filePath string, src io.Reader, dst io.Writer) error {
+	return transformer.inverse.Transform(filePath, src, dst)
+}
+
+func (transformer *reversibleTransformer) Unwrap() Transformer {
+	return transformer.Transformer
+}
+
+// inverseOf returns the transformer undoing transformer, or nil if there is none
+func inverseOf(transformer Transformer) Transformer {
+	found := lookupCapability(transformer, func(transformer Transformer) bool {
+		if pipeline, ok := transformer.(*Pipeline); ok {
+			// a pipeline is only reversible when all of its stages are
+			return pipeline.inverse() != nil
+		}
+		_, ok := transformer.(Inverter)
+		return ok
+	})
+	if pipeline, ok := found.(*Pipeline); ok {
+		return pipeline.inverse()
+	}
+	if inverter, ok := found.(Inverter); ok {
+		return TransformFunc(inverter.Inverse)
+	}
+	return nil
+}
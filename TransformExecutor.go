@@ -0,0 +1,132 @@
+package lambdafs
+
+import (
+	"errors"
+	"io"
+	"sync"
+	"time"
+)
+
+var ErrTransformQueueFull = errors.New("lambdafs: too many transforms queued")
+var ErrTransformTimeout = errors.New("lambdafs: transform timed out")
+
+// errTransformAborted is returned to the transformer reading or writing after a timeout
+var errTransformAborted = errors.New("lambdafs: transform aborted")
+
+// TransformExecutor bounds how many transforms run at once.
+// Transforms beyond maxParallel wait in a queue of at most maxQueued callers,
+// a caller gives up when the queue is full or the timeout expires.
+// Zero means unlimited for each of them.
+type TransformExecutor struct {
+	slots     chan struct{}
+	maxQueued int
+	timeout   time.Duration
+	lock      sync.Mutex
+	queued    int
+}
+
+func NewTransformExecutor(maxParallel int, maxQueued int, timeout time.Duration) *TransformExecutor {
+	executor := &TransformExecutor{
+		maxQueued: maxQueued,
+		timeout:   timeout,
+	}
+	if maxParallel > 0 {
+		executor.slots = make(chan struct{}, maxParallel)
+	}
+	return executor
+}
+
+// Execute runs fn once a slot is free. When the timeout expires, abort is closed
+// and ErrTransformTimeout returned without waiting for fn, which still holds its slot until it returns.
+func (executor *TransformExecutor) Execute(fn func(abort <-chan struct{}) error) error {
+	var deadline <-chan time.Time
+	if executor.timeout > 0 {
+		timer := time.NewTimer(executor.timeout)
+		defer timer.Stop()
+		deadline = timer.C
+	}
+	if executor.slots != nil {
+		select {
+		case executor.slots <- struct{}{}:
+		default:
+			err := executor.enqueue(deadline)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	abort := make(chan struct{})
+	done := make(chan error, 1)
+	go func() {
+		err := fn(abort)
+		if executor.slots != nil {
+			<-executor.slots
+		}
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-deadline:
+		close(abort)
+		return ErrTransformTimeout
+	}
+}
+
+func (executor *TransformExecutor) enqueue(deadline <-chan time.Time) error {
+	executor.lock.Lock()
+	if executor.maxQueued > 0 && executor.queued >= executor.maxQueued {
+		executor.lock.Unlock()
+		return ErrTransformQueueFull
+	}
+	executor.queued++
+	executor.lock.Unlock()
+	defer func() {
+		executor.lock.Lock()
+		executor.queued--
+		executor.lock.Unlock()
+	}()
+	select {
+	case executor.slots <- struct{}{}:
+		return nil
+	case <-deadline:
+		return ErrTransformTimeout
+	}
+}
+
+// abortableReader fails once abort is closed, so a timed out transform stops early
+type abortableReader struct {
+	reader io.Reader
+	abort  <-chan struct{}
+}
+
+func (r *abortableReader) Read(p []byte) (int, error) {
+	select {
+	case <-r.abort:
+		return 0, errTransformAborted
+	default:
+	}
+	return r.reader.Read(p)
+}
+
+// abortableWriter fails once abort is closed
+type abortableWriter struct {
+	writer io.Writer
+	abort  <-chan struct{}
+}
+
+func (w *abortableWriter) Write(p []byte) (int, error) {
+	if isAborted(w.abort) {
+		return 0, errTransformAborted
+	}
+	return w.writer.Write(p)
+}
+
+func isAborted(abort <-chan struct{}) bool {
+	select {
+	case <-abort:
+		return true
+	default:
+		return false
+	}
+}
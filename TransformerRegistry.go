@@ -0,0 +1,101 @@
+package lambdafs
+
+import (
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// TransformerRegistry picks the transformer of a path by pattern, the first registered match wins.
+// A pattern is a path prefix ending with "/" such as "static/", an extension such as ".php" or ".tar.gz",
+// or a glob matched against the base name such as "*.min.js",
+// or against the whole path when it contains "/" such as "conf/*.json".
+// When ChainMatches is set, every matching transformer runs in registration order as a Pipeline.
+type TransformerRegistry struct {
+	ChainMatches bool
+	lock         sync.RWMutex
+	entries      []registryEntry
+}
+
+type registryEntry struct {
+	pattern     string
+	match       func(path string) bool
+	transformer Transformer
+}
+
+func (registry *TransformerRegistry) Register(pattern string, transformer Transformer) error {
+	match, err := compilePattern(pattern)
+	if err != nil {
+		return err
+	}
+	registry.lock.Lock()
+	defer registry.lock.Unlock()
+	registry.entries = append(registry.entries, registryEntry{
+		pattern:     pattern,
+		match:       match,
+		transformer: transformer,
+	})
+	return nil
+}
+
+// Lookup returns the transformer registered for path and its pattern
+func (registry *TransformerRegistry) Lookup(path string) (string, Transformer) {
+	registry.lock.RLock()
+	defer registry.lock.RUnlock()
+	var matched []registryEntry
+	for _, entry := range registry.entries {
+		if !entry.match(path) {
+			continue
+		}
+		if !registry.ChainMatches {
+			return entry.pattern, entry.transformer
+		}
+		matched = append(matched, entry)
+	}
+	if len(matched) == 0 {
+		return "", nil
+	}
+	if len(matched) == 1 {
+		return matched[0].pattern, matched[0].transformer
+	}
+	pipeline := NewPipeline()
+	patterns := make([]string, 0, len(matched))
+	for _, entry := range matched {
+		pipeline.Then(entry.pattern, entry.transformer)
+		patterns = append(patterns, entry.pattern)
+	}
+	return strings.Join(patterns, ","), pipeline
+}
+
+func (registry *TransformerRegistry) isEmpty() bool {
+	registry.lock.RLock()
+	defer registry.lock.RUnlock()
+	return len(registry.entries) == 0
+}
+
+func compilePattern(pattern string) (func(path string) bool, error) {
+	if strings.HasSuffix(pattern, "/") {
+		return func(path string) bool {
+			return strings.HasPrefix(path+"/", pattern)
+		}, nil
+	}
+	if strings.HasPrefix(pattern, ".") && !strings.ContainsAny(pattern, "/*?[\\") {
+		// compared as a suffix, for extensions such as ".tar.gz" to match
+		return func(path string) bool {
+			return strings.HasSuffix(path, pattern)
+		}, nil
+	}
+	if _, err := filepath.Match(pattern, ""); err != nil {
+		return nil, err
+	}
+	if strings.Contains(pattern, "/") {
+		return func(path string) bool {
+			matched, _ := filepath.Match(pattern, path)
+			return matched
+		}, nil
+	}
+	return func(path string) bool {
+		matched, _ := filepath.Match(pattern, filepath.Base(path))
+		return matched
+	}, nil
+}
@@ -0,0 +1,201 @@
+package lambdafs
+
+import (
+	"bytes"
+	"container/list"
+	"sync"
+	"syscall"
+
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/hanwen/go-fuse/fuse/nodefs"
+)
+
+// the outputs kept in memory when VirtualCacheBytes is not set
+const defaultVirtualCacheBytes = 64 << 20
+
+// memoryWriter keeps the output of a transform in memory, it is only readable once closed
+type memoryWriter struct {
+	buffer  bytes.Buffer
+	content []byte
+}
+
+func (w *memoryWriter) Write(p []byte) (int, error) {
+	return w.buffer.Write(p)
+}
+
+func (w *memoryWriter) Close() error {
+	w.content = w.buffer.Bytes()
+	return nil
+}
+
+func (w *memoryWriter) Discard() {
+	w.buffer.Reset()
+}
+
+// virtualFiles holds the outputs of virtual files, the least recently used are evicted past the size limit
+// and transformed again on next access
+type virtualFiles struct {
+	lock    sync.Mutex
+	size    int64
+	lru     *list.List
+	entries map[string]*list.Element
+}
+
+type virtualFileContent struct {
+	path    string
+	content []byte
+}
+
+func (files *virtualFiles) Get(path string) ([]byte, bool) {
+	files.lock.Lock()
+	defer files.lock.Unlock()
+	element, found := files.entries[path]
+	if !found {
+		return nil, false
+	}
+	files.lru.MoveToFront(element)
+	return element.Value.(*virtualFileContent).content, true
+}
+
+func (files *virtualFiles) Has(path string) bool {
+	files.lock.Lock()
+	defer files.lock.Unlock()
+	_, found := files.entries[path]
+	return found
+}
+
+// Put keeps content of path, evicting others until the total fits in limit, content of path itself is always kept
+func (files *virtualFiles) Put(path string, content []byte, limit int64) {
+	files.lock.Lock()
+	defer files.lock.Unlock()
+	if files.entries == nil {
+		files.entries = map[string]*list.Element{}
+		files.lru = list.New()
+	}
+	files.remove(path)
+	files.entries[path] = files.lru.PushFront(&virtualFileContent{path: path, content: content})
+	files.size += int64(len(content))
+	if limit <= 0 {
+		limit = defaultVirtualCacheBytes
+	}
+	for files.size > limit && files.lru.Len() > 1 {
+		evicted := files.lru.Back().Value.(*virtualFileContent)
+		files.remove(evicted.path)
+		if ShouldLogTrace() {
+			LogTrace("evicted virtual file", "path", evicted.path)
+		}
+	}
+}
+
+func (files *virtualFiles) Remove(path string) {
+	files.lock.Lock()
+	defer files.lock.Unlock()
+	files.remove(path)
+}
+
+func (files *virtualFiles) remove(path string) {
+	element, found := files.entries[path]
+	if !found {
+		return
+	}
+	files.lru.Remove(element)
+	delete(files.entries, path)
+	files.size -= int64(len(element.Value.(*virtualFileContent).content))
+}
+
+// virtualOutput brings path up to date and returns its output when it is served from memory.
+// Another access may evict the output before it is read, path is then transformed again
+// rather than served from the source.
+func (fs *LambdaFileSystem) virtualOutput(action string, path string) ([]byte, bool, fuse.Status) {
+	for attempt := 0; attempt < 3; attempt++ {
+		if code := fs.beforeFileAccess(action, path); !code.Ok() {
+			return nil, false, code
+		}
+		if !fs.VirtualFiles {
+			return nil, false, fuse.OK
+		}
+		content, found := fs.virtualFiles.Get(path)
+		if found {
+			return content, true, fuse.OK
+		}
+		entry := fs.manifest.Get(path)
+		if entry == nil || (entry.Origin != OriginVirtual && entry.Origin != OriginError) {
+			return nil, false, fuse.OK
+		}
+		if _, err := getAttr(fs.cache, path); err == nil {
+			// an error file written before virtual files were turned on
+			return nil, false, fuse.OK
+		}
+	}
+	LogWarning("virtual file evicted before read", "path", path)
+	return nil, true, fuse.Status(syscall.EAGAIN)
+}
+
+// virtualAttr is the attr of the source with the size and mode of the output
+func (fs *LambdaFileSystem) virtualAttr(path string, attr *fuse.Attr, content []byte) *fuse.Attr {
+	virtual := *attr
+	virtual.Size = uint64(len(content))
+	virtual.Blocks = (virtual.Size + 511) / 512
+	_, transformer := fs.transformerFor(path)
+	virtual.Mode = attr.Mode&^07777 | outputMode(fs.sourceFilePathOf(path), transformer, attr.Mode)
+	return &virtual
+}
+
+// virtualFile serves the output of a virtual file, reporting the attr of the path instead of the data file default
+type virtualFile struct {
+	nodefs.File
+	attr *fuse.Attr
+}
+
+func (f *virtualFile) GetAttr(out *fuse.Attr) fuse.Status {
+	*out = *f.attr
+	return fuse.OK
+}
+
+func (fs *LambdaFileSystem) openVirtualFile(path string, content []byte, context *fuse.Context) (nodefs.File, fuse.Status) {
+	attr, code := fs.delegate.GetAttr(path, context)
+	if !code.Ok() {
+		return nil, code
+	}
+	return &virtualFile{File: nodefs.NewDataFile(content), attr: fs.virtualAttr(path, attr, content)}, fuse.OK
+}
+
+// materializeVirtualFile writes the output of a virtual file to the rw dir before it is modified through the mount,
+// the rw copy counts as written by the user, keeping the source stamp to detect later source changes
+func (fs *LambdaFileSystem) materializeVirtualFile(action string, path string) fuse.Status {
+	if !fs.VirtualFiles {
+		return fuse.OK
+	}
+	content, virtual, code := fs.virtualOutput(action, path)
+	if !code.Ok() || !virtual {
+		return code
+	}
+	return fs.flights.Run(path, func() fuse.Status {
+		if _, err := getAttr(fs.cache, path); err == nil {
+			fs.virtualFiles.Remove(path)
+			return fuse.OK
+		}
+		attr, code := fs.origin.GetAttr(path, nil)
+		if !code.Ok() {
+			return code
+		}
+		_, transformer := fs.transformerFor(path)
+		dst := fs.newAtomicFileWriter(path, fs.sourceMetadata(path, attr, outputMode(fs.sourceFilePathOf(path), transformer, attr.Mode)))
+		_, err := dst.Write(content)
+		if err == nil {
+			err = dst.Close()
+		}
+		if err != nil {
+			dst.Discard()
+			LogError("failed to materialize virtual file", "reason", action, "path", path, "err", err)
+			return fuse.ToStatus(err)
+		}
+		fs.virtualFiles.Remove(path)
+		fs.dropBranchCache(path)
+		fs.markUserWritten(path)
+		if ShouldLogDebug() {
+			LogDebug("materialized virtual file", "reason", action, "path", path)
+		}
+		return fuse.OK
+	})
+}
@@ -0,0 +1,77 @@
+package lambdafs
+
+import (
+	"path/filepath"
+)
+
+type branchCacheDropper interface {
+	DropBranchCache(names []string)
+}
+
+// dropBranchCache makes unionfs look up again which branch holds path
+func (fs *LambdaFileSystem) dropBranchCache(path string) {
+	if dropper, ok := fs.delegate.(branchCacheDropper); ok {
+		dropper.DropBranchCache([]string{path})
+	}
+}
+
+// invalidatePath makes unionfs and the kernel forget what they cached about path,
+// so open readers see the new rw copy right away under every name the mount shows it as
+func (fs *LambdaFileSystem) invalidatePath(path string) {
+	fs.dropBranchCache(path)
+	if fs.nodeFs == nil {
+		return
+	}
+	for _, mountPath := range fs.mountPaths(path) {
+		fs.notifyMountPath(mountPath)
+	}
+}
+
+func (fs *LambdaFileSystem) notifyMountPath(mountPath string) {
+	fs.nodeFs.FileNotify(mountPath, 0, 0)
+	fs.nodeFs.EntryNotify(parentDir(mountPath), filepath.Base(mountPath))
+}
+
+// invalidateDirView drops the listing of the dir holding path,
+// the virtual entries it synthesized are forgotten by the kernel as their content may change
+func (fs *LambdaFileSystem) invalidateDirView(path string) {
+	if !fs.reshapesTree() {
+		return
+	}
+	dir := parentDir(path)
+	view := fs.dirView(dir)
+	fs.dropDirView(path)
+	if fs.nodeFs == nil {
+		return
+	}
+	var mountDirs []string
+	for _, entry := range view.entries {
+		if entry.Content == nil {
+			continue
+		}
+		if mountDirs == nil {
+			mountDirs = fs.mountPaths(dir)
+		}
+		for _, mountDir := range mountDirs {
+			fs.notifyMountPath(filepath.Join(mountDir, entry.Name))
+		}
+	}
+}
+
+// onOriginChange brings the rw copy of a path changed in any origin layer up to date, and the ones depending on it
+func (fs *LambdaFileSystem) onOriginChange(path string) {
+	if ShouldLogDebug() {
+		LogDebug("origin changed", "path", path)
+	}
+	fs.beforeFileAccess("Watch", path)
+	// the mount names are looked up in the listing before it is dropped
+	fs.invalidatePath(path)
+	fs.invalidateDirView(path)
+	for _, dependent := range fs.dependents(path) {
+		if ShouldLogDebug() {
+			LogDebug("dependency changed", "path", dependent, "dependency", path)
+		}
+		fs.beforeFileAccess("Watch", dependent)
+		fs.invalidatePath(dependent)
+	}
+}
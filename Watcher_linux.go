@@ -0,0 +1,117 @@
+package lambdafs
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"unsafe"
+)
+
+const watchMask = syscall.IN_CLOSE_WRITE | syscall.IN_ATTRIB | syscall.IN_CREATE | syscall.IN_DELETE |
+	syscall.IN_MOVED_FROM | syscall.IN_MOVED_TO | syscall.IN_DELETE_SELF | syscall.IN_ONLYDIR
+
+// originWatcher watches every dir of the origin layers with inotify,
+// the fd is read through os.File so closing it stops the reading goroutine
+type originWatcher struct {
+	fs      *LambdaFileSystem
+	fd      int
+	file    *os.File
+	lock    sync.Mutex
+	watches map[int32]string
+}
+
+func startOriginWatcher(fs *LambdaFileSystem) (*originWatcher, error) {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC | syscall.IN_NONBLOCK)
+	if err != nil {
+		return nil, err
+	}
+	watcher := &originWatcher{
+		fs:      fs,
+		fd:      fd,
+		file:    os.NewFile(uintptr(fd), "inotify"),
+		watches: map[int32]string{},
+	}
+	watcher.addTree("")
+	go watcher.run()
+	return watcher, nil
+}
+
+// addTree watches dir and every dir below it in every origin layer, dir is relative to the origin
+func (watcher *originWatcher) addTree(dir string) {
+	for _, origDir := range watcher.fs.origDirs {
+		watcher.addLayerTree(origDir, dir)
+	}
+}
+
+func (watcher *originWatcher) addLayerTree(origDir string, dir string) {
+	root := filepath.Join(origDir, dir)
+	filepath.Walk(root, func(roPath string, info os.FileInfo, err error) error {
+		if err != nil || !info.IsDir() {
+			return nil
+		}
+		path, err := filepath.Rel(origDir, roPath)
+		if err != nil {
+			return nil
+		}
+		if path == "." {
+			path = ""
+		}
+		wd, err := syscall.InotifyAddWatch(watcher.fd, roPath, watchMask)
+		if err != nil {
+			LogWarning("failed to watch dir", "ro_path", roPath, "err", err)
+			return nil
+		}
+		watcher.lock.Lock()
+		watcher.watches[int32(wd)] = path
+		watcher.lock.Unlock()
+		return nil
+	})
+}
+
+func (watcher *originWatcher) run() {
+	buf := make([]byte, 64*1024)
+	for {
+		n, err := watcher.file.Read(buf)
+		if err != nil {
+			// closed by stop
+			return
+		}
+		offset := 0
+		for offset+syscall.SizeofInotifyEvent <= n {
+			event := (*syscall.InotifyEvent)(unsafe.Pointer(&buf[offset]))
+			nameBytes := buf[offset+syscall.SizeofInotifyEvent : offset+syscall.SizeofInotifyEvent+int(event.Len)]
+			offset += syscall.SizeofInotifyEvent + int(event.Len)
+			name := string(nameBytes)
+			for len(name) > 0 && name[len(name)-1] == 0 {
+				name = name[:len(name)-1]
+			}
+			watcher.handle(event.Wd, event.Mask, name)
+		}
+	}
+}
+
+func (watcher *originWatcher) handle(wd int32, mask uint32, name string) {
+	if mask&syscall.IN_Q_OVERFLOW != 0 {
+		LogWarning("inotify queue overflow, some origin changes are missed")
+		return
+	}
+	watcher.lock.Lock()
+	dir, found := watcher.watches[wd]
+	if mask&syscall.IN_IGNORED != 0 {
+		delete(watcher.watches, wd)
+	}
+	watcher.lock.Unlock()
+	if !found || name == "" {
+		return
+	}
+	path := filepath.Join(dir, name)
+	if mask&syscall.IN_ISDIR != 0 && mask&(syscall.IN_CREATE|syscall.IN_MOVED_TO) != 0 {
+		watcher.addTree(path)
+	}
+	watcher.fs.onOriginChange(path)
+}
+
+func (watcher *originWatcher) stop() {
+	watcher.file.Close()
+}
@@ -0,0 +1,15 @@
+//go:build !linux
+// +build !linux
+
+package lambdafs
+
+import "errors"
+
+type originWatcher struct{}
+
+func startOriginWatcher(fs *LambdaFileSystem) (*originWatcher, error) {
+	return nil, errors.New("lambdafs: watching origin is only supported on linux")
+}
+
+func (watcher *originWatcher) stop() {
+}
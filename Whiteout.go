@@ -0,0 +1,29 @@
+package lambdafs
+
+import (
+	"crypto/md5"
+	"fmt"
+	"path/filepath"
+)
+
+// deletionMarker is the file unionfs keeps under its deletion dir in the rw branch to hide path from the ro ones,
+// named after the md5 of the parent dir and the base name like unionfs does
+func deletionMarker(deletionDirName string, path string) string {
+	dir, base := filepath.Split(path)
+	sum := md5.Sum([]byte(dir))
+	return filepath.Join(deletionDirName, fmt.Sprintf("%x-%s", sum[:8], base))
+}
+
+// isWhitedOut tells if path, or a dir holding it, was deleted or renamed away through the mount,
+// unionfs then hides its source and no rw copy must bring it back
+func (fs *LambdaFileSystem) isWhitedOut(path string) bool {
+	if fs.deletionDirName == "" {
+		return false
+	}
+	for ; path != ""; path = parentDir(path) {
+		if _, code := fs.cache.GetAttr(deletionMarker(fs.deletionDirName, path), nil); code.Ok() {
+			return true
+		}
+	}
+	return false
+}
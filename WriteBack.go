@@ -0,0 +1,92 @@
+package lambdafs
+
+import (
+	"bufio"
+	"hash"
+	"io"
+	"path/filepath"
+	"time"
+)
+
+// writeBack turns the rw copy of path edited through the mount back into the source format
+// and atomically replaces the file in the origin with it.
+// The rw copy then counts as generated from the new source.
+func (fs *LambdaFileSystem) writeBack(path string) {
+	transformerId, transformer := fs.transformerFor(path)
+	inverse := inverseOf(transformer)
+	if inverse == nil {
+		if ShouldLogDebug() {
+			LogDebug("no inverse transformer, skip write back", "path", path)
+		}
+		return
+	}
+	src, err := openFile(fs.cache, path)
+	if err != nil {
+		LogError("failed to open rw file for write back", "path", path, "err", err)
+		return
+	}
+	defer src.Close()
+	// the source is replaced in the origin layer it comes from
+	_, layer, _ := statSource(fs.origin, path)
+	origin := fs.originLayer(layer)
+	err = mkdirAll(origin, parentDir(path), 0755)
+	if err != nil {
+		LogError("failed to create ro path dir", "path", path, "err", err)
+		return
+	}
+	tmpPath := tempFileName(parentDir(path), "."+filepath.Base(path)+".lambdafs-")
+	tmpFile, err := createFile(origin, tmpPath, 0644)
+	if err != nil {
+		LogError("failed to create write back file", "path", path, "err", err)
+		return
+	}
+	var hasher hash.Hash
+	var dst io.Writer = tmpFile
+	if fs.Invalidation == InvalidateByContentHash {
+		hasher = newContentHash()
+		dst = io.MultiWriter(tmpFile, hasher)
+	}
+	buffered := bufio.NewWriter(dst)
+	err = inverse.Transform(fs.sourceFilePath(path, layer), bufio.NewReader(src), buffered)
+	if err == nil {
+		err = buffered.Flush()
+	}
+	err2 := tmpFile.Close()
+	if err == nil {
+		err = err2
+	}
+	if err == nil {
+		mode := uint32(0644)
+		if sourceAttr, statErr := getAttr(origin, path); statErr == nil {
+			mode = sourceAttr.Mode & 07777
+		}
+		err = statusError(origin.Chmod(tmpPath, mode, nil))
+	}
+	if err == nil {
+		err = statusError(origin.Rename(tmpPath, path, nil))
+	}
+	if err != nil {
+		origin.Unlink(tmpPath, nil)
+		LogError("failed to write back", "path", path, "err", err)
+		return
+	}
+	attr, err := getAttr(origin, path)
+	if err != nil {
+		LogError("failed to stat written back file", "path", path, "err", err)
+		return
+	}
+	stamp := newSourceStamp(attr, layer)
+	if hasher != nil {
+		stamp.Hash = formatContentHash(hasher)
+	}
+	now, modTime := time.Now(), attr.ModTime()
+	fs.cache.Utimens(path, &now, &modTime, nil)
+	fs.manifest.Put(&ManifestEntry{
+		Path:        path,
+		Origin:      OriginGenerated,
+		Source:      stamp,
+		Transformer: transformerId,
+		Fingerprint: fingerprintOf(transformer),
+	})
+	LogInfo("written back", "path", path)
+}
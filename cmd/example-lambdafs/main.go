@@ -15,8 +15,7 @@ import (
 	"github.com/hanwen/go-fuse/fuse/pathfs"
 	"github.com/hanwen/go-fuse/unionfs"
 	"github.com/taowen/lambdafs"
-	"io/ioutil"
-	"strings"
+	"io"
 )
 
 func main() {
@@ -57,22 +56,19 @@ func main() {
 	}
 	rootDir := flag.Arg(0)
 	rwDir := flag.Arg(1)
-	lambdafs_, err := lambdafs.NewLambdaFileSystem(rwDir, flag.Arg(2), ufsOptions)
+	lambdafs_, err := lambdafs.NewLayeredLambdaFileSystem(rwDir, flag.Args()[2:], ufsOptions)
 	if err != nil {
 		lambdafs.LogError("create lambdafs failed", "err", err)
 		os.Exit(1)
 	}
-	lambdafs_.UpdateFile = func(filePath string) ([]byte, error) {
-		if !strings.HasSuffix(filePath, ".php") {
-			return nil, nil
-		}
-		content, err := ioutil.ReadFile(filePath)
+	lambdafs_.Transformers.Register(".php", lambdafs.SizeDelta(int64(len("\nhello\n")), lambdafs.TransformFunc(func(filePath string, src io.Reader, dst io.Writer) error {
+		_, err := io.Copy(dst, src)
 		if err != nil {
-			return nil, err
+			return err
 		}
-		content = append(content, []byte("\nhello\n")...)
-		return content, nil
-	}
+		_, err = dst.Write([]byte("\nhello\n"))
+		return err
+	})))
 	nodeFs := pathfs.NewPathNodeFs(lambdafs_, &pathfs.PathNodeFsOptions{ClientInodes: true})
 	mOpts := nodefs.Options{
 		EntryTimeout:    time.Duration(*entry_ttl * float64(time.Second)),